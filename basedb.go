@@ -1,14 +1,40 @@
 package godebian
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"fmt"
 	"sync"
 )
 
 type baseDB struct {
 	db *sql.DB
+}
+
+// txKey is the context key of the transaction of a baseDB.
+type txKey struct{}
+
+// sqlTx is the transaction of the contexts passed to the function of
+// SqliteDb.Transaction.
+type sqlTx struct {
+	db *baseDB
+	tx *sql.Tx
+
 	sync.Mutex
+	// stmts are the statements prepared for tx
+	stmts map[*stmt]*sql.Stmt
+	// ids are the ids interned in tx; they are cached once it is committed
+	ids map[*internTable]map[string]int64
+}
+
+// txOf returns the transaction of db that ctx belongs to, or nil.
+func (db *baseDB) txOf(ctx context.Context) *sqlTx {
+	t, ok := ctx.Value(txKey{}).(*sqlTx)
+	if !ok || t.db != db {
+		return nil
+	}
+
+	return t
 }
 
 type stmt struct {
@@ -18,29 +44,49 @@ type stmt struct {
 	db      *baseDB
 }
 
-func (s *stmt) Query(args ...interface{}) *sql.Rows {
-	s.db.Lock()
-	rows, err := s.stmt.Query(args...)
-	s.db.Unlock()
+// bind returns the statement to run with ctx: s.stmt or, in a transaction,
+// s.stmt prepared for the transaction.
+func (s *stmt) bind(ctx context.Context) *sql.Stmt {
+	t := s.db.txOf(ctx)
+	if t == nil {
+		return s.stmt
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	txStmt, ok := t.stmts[s]
+	if !ok {
+		txStmt = t.tx.StmtContext(ctx, s.stmt)
+		t.stmts[s] = txStmt
+	}
+
+	return txStmt
+}
+
+func (s *stmt) Query(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	rows, err := s.bind(ctx).QueryContext(ctx, args...)
 	if err != nil {
-		log.Fatalf("%s for arguments '%+v' failed: %v", s.name, args, err)
+		return nil, fmt.Errorf("%s for arguments '%+v' failed: %w", s.name, args, err)
 	}
 
-	return rows
+	return rows, nil
 }
 
-func (s *stmt) Exec(args ...interface{}) sql.Result {
-	s.db.Lock()
-	result, err := s.stmt.Exec(args...)
-	s.db.Unlock()
+func (s *stmt) Exec(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	result, err := s.bind(ctx).ExecContext(ctx, args...)
 	if err != nil {
-		log.Fatalf("%s for arguments '%+v' failed: %v", s.name, args, err)
+		return nil, fmt.Errorf("%s for arguments '%+v' failed: %w", s.name, args, err)
 	}
 
-	return result
+	return result, nil
+}
+
+func (s *stmt) Close() error {
+	return s.stmt.Close()
 }
 
-func (db *baseDB) newStmt(name, stmtStr string) *stmt {
+func (db *baseDB) newStmt(name, stmtStr string) (*stmt, error) {
 	var err error
 	stmt := &stmt{}
 
@@ -50,8 +96,8 @@ func (db *baseDB) newStmt(name, stmtStr string) *stmt {
 
 	stmt.stmt, err = db.db.Prepare(stmtStr)
 	if err != nil {
-		log.Fatal(name + ": could not prepare statement: " + err.Error())
+		return nil, fmt.Errorf("%s: could not prepare statement: %w", name, err)
 	}
 
-	return stmt
+	return stmt, nil
 }
@@ -0,0 +1,644 @@
+package godebian
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltSchemaVersion is the version of the bucket layout of BoltDb.
+const boltSchemaVersion = 1
+
+// The buckets of BoltDb; the keys join the parts listed with NUL bytes.
+var (
+	// version
+	boltMeta = []byte("meta")
+	// kind, version, ...
+	boltETags = []byte("etags")
+	// version, index file path: SHA256
+	boltIndexSums = []byte("index_sums")
+	// version, arch, repo, path, package
+	boltFiles = []byte("files")
+	// version, path, arch, repo, package
+	boltPaths = []byte("paths")
+	// version, base name, path, arch, repo, package
+	boltNames = []byte("names")
+	// version, package, path, arch, repo
+	boltPackageFiles = []byte("package_files")
+	// version, arch, package, package version: JSON of storedPackageInfo
+	boltPackageInfos = []byte("package_infos")
+	// version, arch, name, package, package version, field, alternative,
+	// position: JSON of Relation
+	boltRelations = []byte("relations")
+	// version, package: popcon rank
+	boltPopularities = []byte("popularities")
+	// version: update time and content
+	boltReleases = []byte("releases")
+	// version: detached signature of a Release file that is not clearsigned
+	boltReleaseSignatures = []byte("release_signatures")
+)
+
+// BoltDb is a Db stored in a bbolt file; unlike SqliteDb it doesn't need
+// cgo.
+type BoltDb struct {
+	db *bolt.DB
+}
+
+// boltTxKey is the context key of the transaction of a BoltDb.
+type boltTxKey struct{}
+
+// boltTx is the write transaction of the contexts passed to the function of
+// BoltDb.Transaction.
+type boltTx struct {
+	db *BoltDb
+	// mu serializes the use of tx
+	mu sync.Mutex
+	tx *bolt.Tx
+}
+
+// txOf returns the transaction of db that ctx belongs to, or nil.
+func (db *BoltDb) txOf(ctx context.Context) *boltTx {
+	t, ok := ctx.Value(boltTxKey{}).(*boltTx)
+	if !ok || t.db != db {
+		return nil
+	}
+
+	return t
+}
+
+// OpenBoltDb opens or creates the BoltDb at path.
+func OpenBoltDb(path string) (*BoltDb, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open db: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMeta, boltETags, boltIndexSums, boltFiles, boltPaths, boltNames, boltPackageFiles,
+			boltPackageInfos, boltRelations, boltPopularities, boltReleases, boltReleaseSignatures} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("could not create bucket %s: %w", name, err)
+			}
+		}
+
+		meta := tx.Bucket(boltMeta)
+		if v := meta.Get([]byte("version")); v != nil && binary.BigEndian.Uint64(v) > boltSchemaVersion {
+			return fmt.Errorf("%w: %s has schema version %d, but only %d is supported", ErrSchemaTooNew, path, binary.BigEndian.Uint64(v), boltSchemaVersion)
+		}
+
+		return meta.Put([]byte("version"), binary.BigEndian.AppendUint64(nil, boltSchemaVersion))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltDb{db: db}, nil
+}
+
+// Close closes the database file.
+func (db *BoltDb) Close() error {
+	return db.db.Close()
+}
+
+// boltKey joins the parts of a key.
+func boltKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00"))
+}
+
+// boltPrefix returns the prefix of the keys starting with parts.
+func boltPrefix(parts ...string) []byte {
+	return append(boltKey(parts...), 0)
+}
+
+// scan calls f with the parts of the keys of bucket starting with prefix and
+// their values.
+func scan(b *bolt.Bucket, prefix []byte, f func(parts []string, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		err := f(strings.Split(string(k), "\x00"), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *BoltDb) view(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// read-only transactions must not be opened while the write
+	// transaction of the same goroutine is open
+	if t := db.txOf(ctx); t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return f(t.tx)
+	}
+
+	return db.db.View(f)
+}
+
+func (db *BoltDb) update(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if t := db.txOf(ctx); t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return f(t.tx)
+	}
+
+	return db.db.Update(f)
+}
+
+// Transaction runs f in a write transaction; bbolt runs one at a time, while
+// readers with other contexts see the last committed state.
+func (db *BoltDb) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if db.txOf(ctx) != nil {
+		return f(ctx)
+	}
+
+	tx, err := db.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	err = f(context.WithValue(ctx, boltTxKey{}, &boltTx{db: db, tx: tx}))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *BoltDb) setETag(ctx context.Context, etag string, parts ...string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltETags).Put(boltKey(parts...), []byte(etag))
+	})
+}
+
+func (db *BoltDb) getETag(ctx context.Context, parts ...string) (string, error) {
+	var etag string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		etag = string(tx.Bucket(boltETags).Get(boltKey(parts...)))
+		return nil
+	})
+
+	return etag, err
+}
+
+func (db *BoltDb) SetIndexSHA256(ctx context.Context, version, path, sum string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexSums).Put(boltKey(version, path), []byte(sum))
+	})
+}
+
+func (db *BoltDb) GetIndexSHA256(ctx context.Context, version, path string) (string, error) {
+	var sum string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		sum = string(tx.Bucket(boltIndexSums).Get(boltKey(version, path)))
+		return nil
+	})
+
+	return sum, err
+}
+
+func (db *BoltDb) SetContentETag(ctx context.Context, version, arch, repo, etag string) error {
+	return db.setETag(ctx, etag, "contents", version, arch, repo)
+}
+
+func (db *BoltDb) GetContentETag(ctx context.Context, version, arch, repo string) (string, error) {
+	return db.getETag(ctx, "contents", version, arch, repo)
+}
+
+func (db *BoltDb) SetPopularityETag(ctx context.Context, version, etag string) error {
+	return db.setETag(ctx, etag, "popularity", version)
+}
+
+func (db *BoltDb) GetPopularityETag(ctx context.Context, version string) (string, error) {
+	return db.getETag(ctx, "popularity", version)
+}
+
+func (db *BoltDb) SetPackageInfoETag(ctx context.Context, version, repo, arch, etag string) error {
+	return db.setETag(ctx, etag, "packageinfo", version, repo, arch)
+}
+
+func (db *BoltDb) GetPackageInfoETag(ctx context.Context, version, repo, arch string) (string, error) {
+	return db.getETag(ctx, "packageinfo", version, repo, arch)
+}
+
+// fileKeys returns the keys of a file in the buckets of files.
+func fileKeys(version, arch, repo, path, pkg string) map[string][]byte {
+	_, name := splitPath(path)
+
+	return map[string][]byte{
+		string(boltFiles):        boltKey(version, arch, repo, path, pkg),
+		string(boltPaths):        boltKey(version, path, arch, repo, pkg),
+		string(boltNames):        boltKey(version, name, path, arch, repo, pkg),
+		string(boltPackageFiles): boltKey(version, pkg, path, arch, repo),
+	}
+}
+
+func (db *BoltDb) InsertPackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		for bucket, k := range fileKeys(version, arch, repo, path, filePackage) {
+			err := tx.Bucket([]byte(bucket)).Put(k, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func removePackageFile(tx *bolt.Tx, version, arch, repo, path, filePackage string) error {
+	for bucket, k := range fileKeys(version, arch, repo, path, filePackage) {
+		err := tx.Bucket([]byte(bucket)).Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *BoltDb) RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return removePackageFile(tx, version, arch, repo, path, filePackage)
+	})
+}
+
+func (db *BoltDb) RemoveAllPackages(ctx context.Context, version, arch, repo string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		// keys must not be deleted while iterating over them
+		var files [][2]string
+		err := scan(tx.Bucket(boltFiles), boltPrefix(version, arch, repo), func(parts []string, v []byte) error {
+			files = append(files, [2]string{parts[3], parts[4]})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			err = removePackageFile(tx, version, arch, repo, f[0], f[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// byPopularity sorts pkgs like SqliteDb: the most popular packages first,
+// those without popcon rank last.
+func byPopularity(tx *bolt.Tx, version string, pkgs []string) []string {
+	ranks := make(map[string]uint)
+	for _, pkg := range pkgs {
+		ranks[pkg] = getPopularity(tx, version, pkg)
+	}
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return rankLess(ranks[pkgs[i]], ranks[pkgs[j]])
+	})
+
+	return pkgs
+}
+
+func (db *BoltDb) GetPackage(ctx context.Context, version, path string) ([]string, error) {
+	var pkgs []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		if strings.HasPrefix(path, "/") {
+			err = scan(tx.Bucket(boltPaths), boltPrefix(version, path), func(parts []string, v []byte) error {
+				pkgs = append(pkgs, parts[4])
+				return nil
+			})
+		} else {
+			_, name := splitPath("/" + path)
+			err = scan(tx.Bucket(boltNames), boltPrefix(version, name), func(parts []string, v []byte) error {
+				if matchesRelativePath(parts[2], path) {
+					pkgs = append(pkgs, parts[5])
+				}
+				return nil
+			})
+		}
+		pkgs = byPopularity(tx, version, pkgs)
+		return err
+	})
+
+	return pkgs, err
+}
+
+func (db *BoltDb) GetPackages(ctx context.Context, version string, paths []string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		for _, path := range paths {
+			var pkgs []string
+			err := scan(tx.Bucket(boltPaths), boltPrefix(version, path), func(parts []string, v []byte) error {
+				pkgs = append(pkgs, parts[4])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(pkgs) > 0 {
+				ret[path] = byPopularity(tx, version, pkgs)
+			}
+		}
+		return nil
+	})
+
+	return ret, err
+}
+
+func (db *BoltDb) GetPackagesMatching(ctx context.Context, version string, m PathMatcher) ([]string, error) {
+	var pkgs []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		err := scan(tx.Bucket(boltPaths), boltPrefix(version), func(parts []string, v []byte) error {
+			if m.Match(parts[1]) {
+				pkgs = append(pkgs, parts[4])
+			}
+			return ctx.Err()
+		})
+		pkgs = byPopularity(tx, version, pkgs)
+		return err
+	})
+
+	return pkgs, err
+}
+
+func (db *BoltDb) GetFiles(ctx context.Context, version, pkg, arch, repo string) ([]string, error) {
+	var paths []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltPackageFiles), boltPrefix(version, pkg), func(parts []string, v []byte) error {
+			path := parts[2]
+			if (arch == "" || parts[3] == arch) && (repo == "" || parts[4] == repo) &&
+				(len(paths) == 0 || paths[len(paths)-1] != path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	})
+
+	return paths, err
+}
+
+// errWalkStopped ends the scan of Walk once its walker returns false.
+var errWalkStopped = errors.New("walk stopped")
+
+func (db *BoltDb) Walk(ctx context.Context, version, arch, repo string, walker func(path, pkg string) bool) error {
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltFiles), boltPrefix(version, arch, repo), func(parts []string, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !walker(parts[3], parts[4]) {
+				return errWalkStopped
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, errWalkStopped) {
+		return nil
+	}
+
+	return err
+}
+
+func (db *BoltDb) InsertPackageInfo(ctx context.Context, version, repo string, arch string, pi PackageInfo) error {
+	value, err := json.Marshal(storedPackageInfo{Repo: repo, Info: pi})
+	if err != nil {
+		return err
+	}
+
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		err := removePackageInfo(tx, version, "", arch, pi.Name, pi.Version)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltPackageInfos).Put(boltKey(version, arch, pi.Name, pi.Version), value)
+		if err != nil {
+			return err
+		}
+
+		for _, field := range RelationFields {
+			for i, alternatives := range pi.Relations(field) {
+				for j, r := range alternatives {
+					value, err := json.Marshal(r)
+					if err != nil {
+						return err
+					}
+					k := boltKey(version, arch, r.Name, pi.Name, pi.Version, field, fmt.Sprint(i), fmt.Sprint(j))
+					err = tx.Bucket(boltRelations).Put(k, value)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// removePackageInfo removes the package info of pkgVersion of pkg and its
+// relations; an empty repo matches any.
+func removePackageInfo(tx *bolt.Tx, version, repo, arch, pkg, pkgVersion string) error {
+	infos := tx.Bucket(boltPackageInfos)
+	k := boltKey(version, arch, pkg, pkgVersion)
+
+	value := infos.Get(k)
+	if value == nil {
+		return nil
+	}
+	var stored storedPackageInfo
+	err := json.Unmarshal(value, &stored)
+	if err != nil {
+		return err
+	}
+	if repo != "" && stored.Repo != repo {
+		return nil
+	}
+
+	for _, field := range RelationFields {
+		for i, alternatives := range stored.Info.Relations(field) {
+			for j, r := range alternatives {
+				err = tx.Bucket(boltRelations).Delete(boltKey(version, arch, r.Name, pkg, pkgVersion, field, fmt.Sprint(i), fmt.Sprint(j)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return infos.Delete(k)
+}
+
+func (db *BoltDb) RemovePackageInfo(ctx context.Context, version, repo, arch, pkg, pkgVersion string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return removePackageInfo(tx, version, repo, arch, pkg, pkgVersion)
+	})
+}
+
+func (db *BoltDb) RemoveAllPackageInfos(ctx context.Context, version, repo, arch string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		var pkgs [][2]string
+		err := scan(tx.Bucket(boltPackageInfos), boltPrefix(version, arch), func(parts []string, v []byte) error {
+			pkgs = append(pkgs, [2]string{parts[2], parts[3]})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, pkg := range pkgs {
+			err = removePackageInfo(tx, version, repo, arch, pkg[0], pkg[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDb) GetPackageInfo(ctx context.Context, version, arch, pkg string) (PackageInfo, error) {
+	var candidates []PackageInfo
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltPackageInfos), boltPrefix(version, arch, pkg), func(parts []string, v []byte) error {
+			var stored storedPackageInfo
+			err := json.Unmarshal(v, &stored)
+			candidates = append(candidates, stored.Info)
+			return err
+		})
+	})
+	if err != nil {
+		return PackageInfo{}, err
+	}
+
+	pi, ok := NewestPackageInfo(candidates)
+	if !ok {
+		return pi, fmt.Errorf("%w: package %s", ErrNotFound, pkg)
+	}
+
+	return pi, nil
+}
+
+func (db *BoltDb) GetReverseRelations(ctx context.Context, version, arch, name string) ([]ReverseDependency, error) {
+	var rdeps []ReverseDependency
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltRelations), boltPrefix(version, arch, name), func(parts []string, v []byte) error {
+			rd := ReverseDependency{Package: parts[3], Version: parts[4], Field: parts[5]}
+			err := json.Unmarshal(v, &rd.Relation)
+			rdeps = append(rdeps, rd)
+			return err
+		})
+	})
+	sortReverseDependencies(rdeps)
+
+	return rdeps, err
+}
+
+func (db *BoltDb) InsertPackagePopularity(ctx context.Context, version, pkg string, popularity uint) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPopularities).Put(boltKey(version, pkg), binary.BigEndian.AppendUint64(nil, uint64(popularity)))
+	})
+}
+
+func (db *BoltDb) RemoveAllPopularities(ctx context.Context, version string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		var keys [][]byte
+		err := scan(tx.Bucket(boltPopularities), boltPrefix(version), func(parts []string, v []byte) error {
+			keys = append(keys, boltKey(parts...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			err = tx.Bucket(boltPopularities).Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getPopularity(tx *bolt.Tx, version, pkg string) uint {
+	v := tx.Bucket(boltPopularities).Get(boltKey(version, pkg))
+	if v == nil {
+		return 0
+	}
+
+	return uint(binary.BigEndian.Uint64(v))
+}
+
+func (db *BoltDb) GetPackagePopularity(ctx context.Context, version, pkg string) (uint, error) {
+	var popularity uint
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		popularity = getPopularity(tx, version, pkg)
+		return nil
+	})
+
+	return popularity, err
+}
+
+func (db *BoltDb) SetRelease(ctx context.Context, version string, updated time.Time, content, signature []byte) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		if signature == nil {
+			err := tx.Bucket(boltReleaseSignatures).Delete(boltKey(version))
+			if err != nil {
+				return err
+			}
+		} else {
+			err := tx.Bucket(boltReleaseSignatures).Put(boltKey(version), signature)
+			if err != nil {
+				return err
+			}
+		}
+
+		value := binary.BigEndian.AppendUint64(nil, uint64(updated.Unix()))
+		return tx.Bucket(boltReleases).Put(boltKey(version), append(value, content...))
+	})
+}
+
+func (db *BoltDb) GetRelease(ctx context.Context, version string) (time.Time, []byte, []byte, error) {
+	var updated time.Time
+	var content, signature []byte
+	found := false
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltReleases).Get(boltKey(version))
+		if len(v) < 8 {
+			return nil
+		}
+		found = true
+		updated = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		// values are only valid during the transaction
+		content = append([]byte(nil), v[8:]...)
+		if sig := tx.Bucket(boltReleaseSignatures).Get(boltKey(version)); sig != nil {
+			signature = append([]byte(nil), sig...)
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%w: release of %s", ErrNotFound, version)
+	}
+
+	return updated, content, signature, err
+}
@@ -0,0 +1,47 @@
+package godebian
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltDb(t *testing.T) *BoltDb {
+	d, err := OpenBoltDb(filepath.Join(t.TempDir(), "godebian.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+func TestBoltDbConformance(t *testing.T) {
+	testDbConformance(t, newTestBoltDb(t))
+}
+
+func TestOpenBoltDbRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godebian.bolt")
+	d, err := OpenBoltDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMeta).Put([]byte("version"), []byte{0, 0, 0, 0, 0, 0, 0, boltSchemaVersion + 1})
+	})
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBoltDb(path)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening a newer bolt db should fail with ErrSchemaTooNew, but error is %v", err)
+	}
+}
+
+func TestBoltDbTransactions(t *testing.T) {
+	testDbTransactions(t, newTestBoltDb(t))
+}
@@ -1,56 +1,213 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"syscall"
+	"time"
 
 	godebian "github.com/btwotch/godebian"
 	"github.com/spf13/cobra"
 )
 
+var (
+	mirror   string
+	arches   []string
+	keyring  string
+	maxAge   time.Duration
+	postgres string
+)
+
+func contentsOptions(distro, version string) (godebian.ContentsOptions, error) {
+	var opts godebian.ContentsOptions
+	switch distro {
+	case "debian":
+		opts = godebian.DebianOptions(version)
+	case "ubuntu":
+		opts = godebian.UbuntuOptions(version)
+	default:
+		return opts, fmt.Errorf("unknown distro %q, valid values are: debian, ubuntu", distro)
+	}
+
+	if mirror != "" {
+		opts.MirrorURL = mirror
+	}
+	if len(arches) > 0 {
+		opts.Architectures = arches
+	}
+	opts.Keyring = keyring
+
+	return opts, nil
+}
+
+// openContents opens the index of distro/version and updates it if it is
+// older than --max-age. If the update fails, e.g. because the mirror is
+// unreachable, an index imported before is used anyway.
+func openContents(ctx context.Context, d godebian.Db, distro, version string) (godebian.DebianContents, error) {
+	opts, err := contentsOptions(distro, version)
+	if err != nil {
+		return godebian.DebianContents{}, err
+	}
+	c, err := openStoredContents(opts, d)
+	if err != nil {
+		return c, err
+	}
+
+	if maxAge > 0 || c.LastUpdate().IsZero() {
+		_, err = c.UpdateIfStale(ctx, maxAge)
+		if err != nil && !c.LastUpdate().IsZero() {
+			fmt.Fprintf(os.Stderr, "updating the index of %s %s failed, using the one of %s: %v\n",
+				distro, version, c.LastUpdate().Format(time.DateTime), err)
+			err = nil
+		}
+	}
+
+	return c, err
+}
+
+// openStoredContents opens the index of opts. A stored Release file that has
+// expired or is no longer trusted isn't an error, as updating the index
+// replaces it.
+func openStoredContents(opts godebian.ContentsOptions, d godebian.Db) (godebian.DebianContents, error) {
+	c, err := godebian.OpenContents(opts, d)
+	if errors.Is(err, godebian.ErrReleaseExpired) || errors.Is(err, godebian.ErrBadSignature) {
+		err = nil
+	}
+
+	return c, err
+}
+
+// updateContents updates the index of opts.
+func updateContents(ctx context.Context, opts godebian.ContentsOptions, d godebian.Db) error {
+	c, err := openStoredContents(opts, d)
+	if err != nil {
+		return err
+	}
+
+	return c.Update(ctx)
+}
+
+// openDb opens the PostgreSQL database of --postgres or else the SQLite
+// database in the home directory.
+func openDb(ctx context.Context) (godebian.Db, error) {
+	if postgres != "" {
+		return godebian.OpenPostgresDb(ctx, postgres)
+	}
+
+	var d godebian.SqliteDb
+	err := d.Open()
+
+	return &d, err
+}
+
+// packageDetails returns the package info and popularity of pkg; packages
+// without package info are shown with empty info.
+func packageDetails(ctx context.Context, c godebian.DebianContents, pkg string) (godebian.PackageInfo, uint, error) {
+	pkginfo, err := c.PackageInfoContext(ctx, pkg)
+	if err != nil && !errors.Is(err, godebian.ErrNotFound) {
+		return pkginfo, 0, err
+	}
+
+	pop, err := c.PopularityContext(ctx, pkg)
+
+	return pkginfo, pop, err
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func main() {
 	var c godebian.DebianContents
-	var d godebian.SqliteDb
+	var d godebian.Db
+	var err error
 
-	d.Open()
 	rootCmd := &cobra.Command{
 		Use:   "goapt",
 		Short: "goapt - example cmd for godebian",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			d, err = openDb(cmd.Context())
+			return err
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&mirror, "mirror", "", "base URL of the archive mirror")
+	rootCmd.PersistentFlags().StringSliceVar(&arches, "arch", nil, "architectures to index (default depends on distro)")
+	rootCmd.PersistentFlags().StringVar(&keyring, "keyring", "", "OpenPGP keyring to verify the Release file with")
+	rootCmd.PersistentFlags().StringVar(&postgres, "postgres", os.Getenv("GODEBIAN_POSTGRES"), "use the PostgreSQL database of this DSN instead of ~/.godebian.sqlite")
+	rootCmd.PersistentFlags().DurationVar(&maxAge, "max-age", 24*time.Hour, "update the index if it is older than this; 0 only updates indices that have never been imported")
 
+	var searchOpts godebian.SearchOptions
+	var useRegexp, useGlob, useSubstring bool
 	searchCmd := &cobra.Command{
 		Use:   "search",
 		Short: "<ubuntu|debian> version path",
-		Args:  cobra.ExactArgs(3),
-		Run: func(cmd *cobra.Command, args []string) {
+		Long: `Search the packages containing path.
+
+Regexp, glob and substring searches use a trigram index of the paths with
+PostgreSQL, and with SQLite if it has FTS5, i.e. if go-apt-files is built
+with -tags sqlite_fts5 or with CGO_ENABLED=0 -tags sqlite_purego; otherwise
+they scan all files.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
 			path := args[2]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
+			}
+			switch {
+			case useRegexp:
+				searchOpts.Mode = godebian.SearchRegexp
+			case useGlob:
+				searchOpts.Mode = godebian.SearchGlob
+			case useSubstring:
+				searchOpts.Mode = godebian.SearchSubstring
+			}
+			packages, err := c.SearchContext(cmd.Context(), path, searchOpts)
+			if err != nil {
+				return err
 			}
-			packages := c.Search(path)
 			for _, pkg := range packages {
-				pkginfo := c.PackageInfo(pkg)
-				pop := c.Popularity(pkg)
-				fmt.Printf("%s | package info: %+v | popularity: %d\n", pkg, pkginfo, pop)
+				pkginfo, pop, err := packageDetails(cmd.Context(), c, pkg)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s | %s | %s | popularity: %d\n", pkg, pkginfo.Version, pkginfo.Description, pop)
 			}
+			return nil
 		},
 	}
+	searchCmd.Flags().BoolVarP(&useRegexp, "regexp", "x", false, "match paths against a regular expression")
+	searchCmd.Flags().BoolVarP(&useGlob, "glob", "g", false, "match whole paths against a shell glob")
+	searchCmd.Flags().BoolVarP(&useSubstring, "substring", "s", false, "match paths containing the pattern")
+	searchCmd.Flags().BoolVarP(&searchOpts.IgnoreCase, "ignore-case", "i", false, "match case insensitively")
+	searchCmd.MarkFlagsMutuallyExclusive("regexp", "glob", "substring")
 
 	searchDirContentsCmd := &cobra.Command{
 		Use:   "search-dir-contents",
 		Short: "<ubuntu|debian> version dir",
 		Args:  cobra.ExactArgs(3),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
 			path := args[2]
@@ -60,29 +217,69 @@ func main() {
 				paths = append(paths, path)
 				return nil
 			})
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
 			}
 			fmt.Printf("len(paths) = %d\n", len(paths))
-			packages := c.SearchPaths(paths)
+			packages, err := c.SearchPathsContext(cmd.Context(), paths)
+			if err != nil {
+				return err
+			}
 			for path, pkgs := range packages {
 				if len(pkgs) > 1 {
 					fmt.Println()
 				}
 				for _, pkg := range pkgs {
-					pkginfo := c.PackageInfo(pkg)
-					pop := c.Popularity(pkg)
+					pkginfo, pop, err := packageDetails(cmd.Context(), c, pkg)
+					if err != nil {
+						return err
+					}
 					if len(pkgs) > 1 {
 						fmt.Printf("    ")
 					}
-					fmt.Printf("%s: %s | package info: %+v | popularity: %d\n", path, pkg, pkginfo, pop)
+					fmt.Printf("%s: %s | %s | %s | popularity: %d\n", path, pkg, pkginfo.Version, pkginfo.Description, pop)
 				}
 				if len(pkgs) > 1 {
 					fmt.Println()
 				}
 			}
+			return nil
+		},
+	}
+
+	var popcon string
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "<ubuntu|debian> version dir",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			distro := args[0]
+			version := args[1]
+			opts, err := contentsOptions(distro, version)
+			if err != nil {
+				return err
+			}
+			opts.MirrorURL = args[2]
+			opts.PopconURL = popcon
+			_, err = godebian.NewContentsContext(cmd.Context(), opts, d)
+			return err
+		},
+	}
+	importCmd.Flags().StringVar(&popcon, "popcon", "", "local popcon by_vote file to import")
+
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "<ubuntu|debian> version",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			distro := args[0]
+			version := args[1]
+			opts, err := contentsOptions(distro, version)
+			if err != nil {
+				return err
+			}
+			return updateContents(cmd.Context(), opts, d)
 		},
 	}
 
@@ -90,33 +287,97 @@ func main() {
 		Use:   "show",
 		Short: "<ubuntu|debian> version package",
 		Args:  cobra.ExactArgs(3),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
 			pkg := args[2]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
+			}
+			pi, err := c.PackageInfoContext(cmd.Context(), pkg)
+			if err != nil {
+				return err
+			}
+			if pi.Fields == nil {
+				fmt.Printf("%+v\n", pi)
+				return nil
 			}
-			pi := c.PackageInfo(pkg)
-			fmt.Printf("%+v\n", pi)
+			fmt.Print(pi.Fields)
+			return nil
 		},
 	}
 
+	var transitive bool
+	var kinds []string
+	rdependsCmd := &cobra.Command{
+		Use:   "rdepends",
+		Short: "<ubuntu|debian> version package",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			distro := args[0]
+			version := args[1]
+			pkg := args[2]
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
+			}
+			var rdeps []godebian.ReverseDependency
+			if transitive {
+				rdeps, err = c.TransitiveReverseDependsContext(cmd.Context(), pkg, kinds...)
+			} else {
+				rdeps, err = c.ReverseDependsContext(cmd.Context(), pkg, kinds...)
+			}
+			if err != nil {
+				return err
+			}
+			for _, rdep := range rdeps {
+				fmt.Printf("%s: %s %s\n", rdep.Package, rdep.Field, rdep.Relation)
+			}
+			return nil
+		},
+	}
+	rdependsCmd.Flags().BoolVar(&transitive, "transitive", false, "also list the reverse dependencies of the reverse dependencies")
+	rdependsCmd.Flags().StringSliceVar(&kinds, "kind", nil, "relation fields to follow, e.g. Depends,Recommends (default Depends,Pre-Depends)")
+
+	var filter godebian.FileFilter
+	filesCmd := &cobra.Command{
+		Use:   "files",
+		Short: "<ubuntu|debian> version package",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			distro := args[0]
+			version := args[1]
+			pkg := args[2]
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
+			}
+			files, err := c.ListFilesContext(cmd.Context(), pkg, filter)
+			if err != nil {
+				return err
+			}
+			for _, path := range files {
+				fmt.Printf("%s: %s\n", pkg, path)
+			}
+			return nil
+		},
+	}
+	filesCmd.Flags().StringVar(&filter.Arch, "filter-arch", "", "only list files of this architecture")
+	filesCmd.Flags().StringVar(&filter.Repo, "filter-repo", "", "only list files of this component, e.g. main")
+
 	listCmd := &cobra.Command{
 		Use:   "list",
 		Short: "<ubuntu|debian> version package",
 		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
 			}
-			c.Walk("amd64", "main", func(path, pkg string) bool {
+			return c.WalkContext(cmd.Context(), "amd64", "main", func(path, pkg string) bool {
 				fmt.Printf("%s:\t\t%s\n", path, pkg)
 				return true
 			})
@@ -127,17 +388,16 @@ func main() {
 		Use:   "pc",
 		Short: "<ubuntu|debian> version package",
 		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
 			}
 			pkg2files := make(map[string]map[string]struct{})
 			rex := regexp.MustCompile("^.*\\.pc$")
-			c.Walk("amd64", "main", func(path, pkg string) bool {
+			err = c.WalkContext(cmd.Context(), "amd64", "main", func(path, pkg string) bool {
 				if rex.MatchString(path) {
 					if pkg2files[pkg] == nil {
 						pkg2files[pkg] = make(map[string]struct{})
@@ -147,11 +407,14 @@ func main() {
 				}
 				return true
 			})
+			if err != nil {
+				return err
+			}
 
 			for pkg, paths := range pkg2files {
 				fmt.Printf("%s -> %+v\n", pkg, paths)
 
-				c.Extract(pkg, func(fp io.Reader, fi godebian.FileInfo) {
+				err := c.ExtractContext(cmd.Context(), pkg, func(fp io.Reader, fi godebian.FileInfo) {
 					fiPath := fi.Path[1:]
 					_, found := paths[fiPath]
 					if found {
@@ -166,7 +429,11 @@ func main() {
 					}
 
 				})
+				if err != nil {
+					return err
+				}
 			}
+			return nil
 		},
 	}
 
@@ -174,18 +441,21 @@ func main() {
 		Use:   "download",
 		Short: "<ubuntu|debian> version package",
 		Args:  cobra.ExactArgs(3),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
 			pkg := args[2]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
 			}
 
-			url := c.PackageURL(pkg)
+			url, err := c.PackageURLContext(cmd.Context(), pkg)
+			if err != nil {
+				return err
+			}
 			fmt.Printf("%s\n", url)
+			return nil
 		},
 	}
 
@@ -193,15 +463,14 @@ func main() {
 		Use:   "extract",
 		Short: "<ubuntu|debian> version package path",
 		Args:  cobra.ExactArgs(4),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			distro := args[0]
 			version := args[1]
 			pkg := args[2]
 			baseDir := args[3]
-			if distro == "ubuntu" {
-				c = godebian.NewUbuntuContents(version, &d)
-			} else if distro == "debian" {
-				c = godebian.NewDebianContents(version, &d)
+			c, err = openContents(cmd.Context(), d, distro, version)
+			if err != nil {
+				return err
 			}
 
 			f := func(fp io.Reader, fi godebian.FileInfo) {
@@ -228,18 +497,52 @@ func main() {
 					}
 				}
 			}
-			c.Extract(pkg, f)
+			return c.ExtractContext(cmd.Context(), pkg, f)
+		},
+	}
+
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "show the size of the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sd, ok := d.(*godebian.SqliteDb)
+			if !ok {
+				return errors.New("stats are only available for SQLite databases")
+			}
+			st, err := sd.Stats(cmd.Context())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("database size: %s\n", formatBytes(st.Size))
+			fmt.Printf("files: %d, suites: %d, packages: %d, directories: %d\n", st.Files, st.Suites, st.Packages, st.Dirs)
+			fmt.Printf("file data: %s interned instead of %s flat", formatBytes(st.InternedSize), formatBytes(st.FlatSize))
+			if st.FlatSize > 0 {
+				fmt.Printf(" (%.1f%% saved)", 100-100*float64(st.InternedSize)/float64(st.FlatSize))
+			}
+			fmt.Println()
+			return nil
 		},
 	}
 
 	rootCmd.AddCommand(searchCmd)
 	rootCmd.AddCommand(searchDirContentsCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(getPCsCmd)
 	rootCmd.AddCommand(packageInfoCmd)
+	rootCmd.AddCommand(rdependsCmd)
+	rootCmd.AddCommand(filesCmd)
+	rootCmd.AddCommand(statsCmd)
 	rootCmd.AddCommand(packageDownloadCmd)
 	rootCmd.AddCommand(packageExtractCmd)
 
-	rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if rootCmd.ExecuteContext(ctx) != nil {
+		os.Exit(1)
+	}
 
 }
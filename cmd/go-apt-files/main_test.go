@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	godebian "github.com/btwotch/godebian"
+)
+
+// writeMirror writes a local Debian archive with a Contents file of stable.
+func writeMirror(t *testing.T, contents string) string {
+	dir := t.TempDir()
+	distsDir := filepath.Join(dir, "dists", "stable")
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(contents))
+	w.Close()
+
+	err := os.MkdirAll(filepath.Join(distsDir, "main"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(distsDir, "main", "Contents-amd64.gz"), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := fmt.Sprintf("Suite: stable\nArchitectures: amd64\nComponents: main\nSHA256:\n %x %d main/Contents-amd64.gz\n",
+		sha256.Sum256(buf.Bytes()), buf.Len())
+	err = os.WriteFile(filepath.Join(distsDir, "Release"), []byte(release), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestOpenContentsOffline(t *testing.T) {
+	ctx := context.Background()
+	d := godebian.NewMemoryDb()
+
+	oldMirror, oldMaxAge := mirror, maxAge
+	defer func() { mirror, maxAge = oldMirror, oldMaxAge }()
+	mirror = "http://127.0.0.1:1/debian/"
+	maxAge = time.Nanosecond
+
+	_, err := openContents(ctx, d, "debian", "stable")
+	if err == nil {
+		t.Fatalf("opening an index that was never imported should fail with an unreachable mirror")
+	}
+
+	_, err = godebian.NewContents(godebian.ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     writeMirror(t, "usr/bin/foo\tutils/foo\n"),
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+	}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	c, err := openContents(ctx, d, "debian", "stable")
+	if err != nil {
+		t.Fatalf("stale index should be used with an unreachable mirror, but opening it failed: %v", err)
+	}
+	if pkgs, err := c.SearchContext(ctx, "/usr/bin/foo", godebian.SearchOptions{}); err != nil || len(pkgs) != 1 || pkgs[0] != "foo" {
+		t.Errorf("/usr/bin/foo should be in foo, but is in %+v (%v)", pkgs, err)
+	}
+}
+
+func TestUpdateExpiredRelease(t *testing.T) {
+	ctx := context.Background()
+	d := godebian.NewMemoryDb()
+
+	opts := godebian.ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     writeMirror(t, "usr/bin/foo\tutils/foo\n"),
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+	}
+
+	err := updateContents(ctx, opts, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stored Release file expired since the last update
+	_, release, _, err := d.GetRelease(ctx, "debian/stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetRelease(ctx, "debian/stable", time.Now(), append(release, "Valid-Until: Sat, 17 Feb 2024 09:48:20 UTC\n"...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updateContents(ctx, opts, d)
+	if err != nil {
+		t.Fatalf("update should replace the expired Release file, but failed: %v", err)
+	}
+	_, release, _, err = d.GetRelease(ctx, "debian/stable")
+	if err != nil || bytes.Contains(release, []byte("Valid-Until")) {
+		t.Errorf("stored Release file should be the one of the mirror, but is %q (%v)", release, err)
+	}
+}
+
+func TestContentsOptionsUnknownDistro(t *testing.T) {
+	for _, distro := range []string{"debian", "ubuntu"} {
+		opts, err := contentsOptions(distro, "stable")
+		if err != nil || opts.Distro != distro {
+			t.Errorf("%s should be a valid distro, but got %q (%v)", distro, opts.Distro, err)
+		}
+	}
+
+	_, err := contentsOptions("fedora", "stable")
+	if err == nil || !strings.Contains(err.Error(), "debian, ubuntu") {
+		t.Errorf("fedora should be rejected with the valid distros, but got %v", err)
+	}
+}
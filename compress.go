@@ -0,0 +1,81 @@
+package godebian
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressions are the file extensions of index file variants, best first.
+var compressions = []string{".xz", ".zst", ".gz", ".bz2", ""}
+
+// splitCompression splits an index file path into the path of the
+// uncompressed file and its compression extension.
+func splitCompression(path string) (string, string) {
+	for _, ext := range compressions {
+		if ext != "" && strings.HasSuffix(path, ext) {
+			return strings.TrimSuffix(path, ext), ext
+		}
+	}
+
+	return path, ""
+}
+
+func compressionRank(ext string) int {
+	for i, e := range compressions {
+		if e == ext {
+			return i
+		}
+	}
+
+	return len(compressions)
+}
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error {
+	return nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+
+	return nil
+}
+
+// decompress returns a reader for the uncompressed content of r, picking the
+// decompressor by the extension of path.
+func decompress(r io.Reader, path string) (io.ReadCloser, error) {
+	_, ext := splitCompression(path)
+
+	switch ext {
+	case ".xz":
+		xzr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return nopReadCloser{xzr}, nil
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{zr}, nil
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".bz2":
+		return nopReadCloser{bzip2.NewReader(r)}, nil
+	}
+
+	return nopReadCloser{r}, nil
+}
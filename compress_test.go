@@ -0,0 +1,58 @@
+package godebian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompress(t *testing.T) {
+	content := "usr/bin/foo\tutils/foo\n"
+
+	compressors := map[string]func(w io.Writer) (io.WriteCloser, error){
+		".gz": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		".xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		".zst": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+	}
+
+	for ext, newWriter := range compressors {
+		var buf bytes.Buffer
+		w, err := newWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+		w.Close()
+
+		r, err := decompress(&buf, "main/Contents-amd64"+ext)
+		if err != nil {
+			t.Fatalf("%s: decompressing failed: %v", ext, err)
+		}
+		out, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(out) != content {
+			t.Fatalf("%s: decompressed content should be %q, but is %q (%v)", ext, content, out, err)
+		}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -1,26 +1,37 @@
 package godebian
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type SqliteDb struct {
-	dbPath        string
-	inTransaction bool
+	dbPath string
+	// writeMu serializes the transactions
+	writeMu sync.Mutex
+	// pathIndex is set if file_fts is available
+	pathIndex bool
 	baseDB
 
+	suites   internTable
+	packages internTable
+	dirs     internTable
+
 	setContentETagStmt              *stmt
 	getContentETagStmt              *stmt
 	setPopularityETagStmt           *stmt
 	getPopularityETagStmt           *stmt
 	setPackageInfoETagStmt          *stmt
 	getPackageInfoETagStmt          *stmt
+	setIndexSHA256Stmt              *stmt
+	getIndexSHA256Stmt              *stmt
 	insertPackageFileStmt           *stmt
 	insertPackageInfoStmt           *stmt
 	insertPackagePopularityStmt     *stmt
@@ -32,185 +43,380 @@ type SqliteDb struct {
 	removeAllPackagesStmt           *stmt
 	removeAllPackageInfosStmt       *stmt
 	removeAllPopularitiesStmt       *stmt
+	removePackageFileStmt           *stmt
+	removePackageInfoStmt           *stmt
+	setReleaseStmt                  *stmt
+	insertSuiteStmt                 *stmt
+	getSuiteStmt                    *stmt
+	insertPackageStmt               *stmt
+	getPackageIDStmt                *stmt
+	insertDirStmt                   *stmt
+	getDirStmt                      *stmt
+	insertRelationStmt              *stmt
+	getRelationsStmt                *stmt
+	removeRelationsStmt             *stmt
+	removeAllRelationsStmt          *stmt
+	getReverseRelationsStmt         *stmt
+	getFilesOfPackageStmt           *stmt
+	getPackageByPathLikeStmt        *stmt
+	getReleaseStmt                  *stmt
+	insertPathIndexStmt             *stmt
+	removeAllPathIndexStmt          *stmt
+	removePathIndexStmt             *stmt
+	getPackageByPathMatchStmt       *stmt
 }
 
-func (db *SqliteDb) Open() {
+func (db *SqliteDb) Open() error {
 	var err error
 
 	if db.dbPath == "" {
 		dirname, err := os.UserHomeDir()
 		if err != nil {
-			panic(err)
+			return err
 		}
 		db.dbPath = filepath.Join(dirname, ".godebian.sqlite")
 	}
 
-	db.db, err = sql.Open("sqlite3", db.dbPath)
+	db.db, err = sql.Open(sqliteDriver, sqliteDSN(db.dbPath))
 	if err != nil {
-		panic("Could not open db: " + err.Error())
+		return fmt.Errorf("could not open db: %w", err)
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS etag_contents (version VARCHAR, arch VARCHAR, repo VARCHAR, current VARCHAR, PRIMARY KEY(version, arch, repo))`)
+	err = db.migrate()
 	if err != nil {
-		panic("Could not create table etag: " + err.Error())
+		return err
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS etag_popularity (version VARCHAR, current VARCHAR, PRIMARY KEY(version))`)
+	err = db.createPathIndex()
 	if err != nil {
-		panic("Could not create table etag: " + err.Error())
+		return err
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS etag_packageinfo (version VARCHAR, repo VARCHAR, arch VARCHAR, current VARCHAR, PRIMARY KEY(version, repo, arch))`)
+	err = db.prepareStatements()
 	if err != nil {
-		panic("Could not create table etag: " + err.Error())
+		return err
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS file2package (version VARCHAR, arch VARCHAR, repo VARCHAR, path VARCHAR, package VARCHAR, PRIMARY KEY(version, arch, repo, path, package))`)
+	_, err = db.db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
-		panic("Could not create table file2package: " + err.Error())
+		return err
 	}
-	_, err = db.db.Exec(`CREATE INDEX IF NOT EXISTS file2package_path_idx ON file2package(path);`)
+
+	return nil
+}
+
+// createPathIndex creates file_fts, a trigram index of the paths of the
+// files, keyed by the ids of file, that lets substring, glob and regexp
+// searches skip the scan of all files. It needs SQLite with FTS5, i.e.
+// building with the tag sqlite_fts5 or sqlite_purego; without it, the index
+// is left out. A database that has an index is then used without it and
+// marked with the table path_index_stale, as the index misses the changes
+// made meanwhile; the next build with FTS5 opening it rebuilds the index.
+func (db *SqliteDb) createPathIndex() error {
+	var exists, stale int
+	err := db.db.QueryRow(`SELECT coalesce(sum(name = 'file_fts'), 0), coalesce(sum(name = 'path_index_stale'), 0) FROM sqlite_master`).Scan(&exists, &stale)
 	if err != nil {
-		panic("Could not create index on file2package: " + err.Error())
+		return fmt.Errorf("could not look up path index: %w", err)
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS package2popularity (version VARCHAR, package VARCHAR, popularity INTEGER, PRIMARY KEY(version, package))`)
+	_, err = db.db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS file_fts USING fts5(path, content = '', contentless_delete = 1, tokenize = 'trigram')`)
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		db.pathIndex = false
+		return nil
+	}
 	if err != nil {
-		panic("Could not create table package2popularity: " + err.Error())
+		return fmt.Errorf("could not create path index: %w", err)
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS packageinfo (version VARCHAR, repo VARCHAR, package VARCHAR, package_version VARCHAR, arch VARCHAR, filename VARCHAR,
-		PRIMARY KEY(version, package, package_version, arch))`)
+	// creating an existing table succeeds even without FTS5
+	_, err = db.db.Exec(`SELECT rowid FROM file_fts LIMIT 0`)
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		db.pathIndex = false
+		_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS path_index_stale (id INTEGER)`)
+		if err != nil {
+			return fmt.Errorf("could not mark path index as stale: %w", err)
+		}
+		return nil
+	}
 	if err != nil {
-		panic("Could not create table packageinfo: " + err.Error())
+		return fmt.Errorf("could not open path index: %w", err)
 	}
+	db.pathIndex = true
 
-	db.prepareStatements()
+	if exists == 0 || stale > 0 {
+		err = db.fillPathIndex(stale > 0)
+		if err != nil {
+			return fmt.Errorf("could not fill path index: %w", err)
+		}
+	}
 
-	_, err = db.db.Exec("PRAGMA journal_mode=WAL")
+	return nil
+}
+
+// fillPathIndex indexes the paths imported before the index was created or,
+// if rebuild is set, while the database was used without the index.
+func (db *SqliteDb) fillPathIndex(rebuild bool) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`INSERT INTO file_fts (rowid, path) SELECT id, path FROM file2package`,
+		`DROP TABLE IF EXISTS path_index_stale`,
+	}
+	if rebuild {
+		stmts = append([]string{`INSERT INTO file_fts (file_fts) VALUES ('delete-all')`}, stmts...)
+	}
+	err = execMigration(stmts...)(tx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	db.inTransaction = false
+	return tx.Commit()
 }
 
-func (db *SqliteDb) prepareStatements() {
-	var stmts = []struct {
+func (db *SqliteDb) prepareStatements() error {
+	type stmtDefinition struct {
 		name    string
 		stmtStr string
 		stmt    **stmt
-	}{
+	}
+
+	var stmts = []stmtDefinition{
 		{"set contents ETag", "INSERT OR REPLACE INTO etag_contents (version, arch, repo, current) VALUES (?, ?, ?, ?)", &db.setContentETagStmt},
 		{"get contents ETag", "SELECT current FROM etag_contents WHERE version = ? AND arch = ? AND repo = ?", &db.getContentETagStmt},
 		{"set popularity ETag", "INSERT OR REPLACE INTO etag_popularity (version, current) VALUES (?, ?)", &db.setPopularityETagStmt},
 		{"get popularity ETag", "SELECT current FROM etag_popularity WHERE version = ?", &db.getPopularityETagStmt},
 		{"set packageinfo ETag", "INSERT OR REPLACE INTO etag_packageinfo (version, repo, arch, current) VALUES (?, ?, ?, ?)", &db.setPackageInfoETagStmt},
 		{"get packageinfo ETag", "SELECT current FROM etag_packageinfo WHERE version = ? AND repo = ? AND arch = ?", &db.getPackageInfoETagStmt},
-		{"insert package file", "INSERT OR REPLACE INTO file2package (version, arch, repo, path, package) VALUES (?, ?, ?, ?, ?)", &db.insertPackageFileStmt},
-		{"insert package info", "INSERT OR REPLACE INTO packageinfo (version, repo, package, package_version, arch, filename) VALUES (?, ?, ?, ?, ?, ?)", &db.insertPackageInfoStmt},
+		{"set index SHA256", "INSERT OR REPLACE INTO index_sha256 (version, path, sha256) VALUES (?, ?, ?)", &db.setIndexSHA256Stmt},
+		{"get index SHA256", "SELECT sha256 FROM index_sha256 WHERE version = ? AND path = ?", &db.getIndexSHA256Stmt},
+		{"insert suite", "INSERT OR IGNORE INTO suite (version, arch, repo) VALUES (?, ?, ?)", &db.insertSuiteStmt},
+		{"get suite", "SELECT id FROM suite WHERE version = ? AND arch = ? AND repo = ?", &db.getSuiteStmt},
+		{"insert package", "INSERT OR IGNORE INTO package (name) VALUES (?)", &db.insertPackageStmt},
+		{"get package", "SELECT id FROM package WHERE name = ?", &db.getPackageIDStmt},
+		{"insert dir", "INSERT OR IGNORE INTO dir (path) VALUES (?)", &db.insertDirStmt},
+		{"get dir", "SELECT id FROM dir WHERE path = ?", &db.getDirStmt},
+		{"insert package file", "INSERT OR IGNORE INTO file (suite_id, dir_id, name, package_id) VALUES (?, ?, ?, ?)", &db.insertPackageFileStmt},
+		{"insert package info", `INSERT OR REPLACE INTO packageinfo (version, repo, package, package_version, arch, filename,
+									architecture, source, section, priority, maintainer, installed_size, size, sha256, md5sum, homepage, multi_arch,
+									description, long_description, depends, pre_depends, recommends, suggests, conflicts, breaks, replaces, provides, enhances, control)
+								VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, &db.insertPackageInfoStmt},
 		{"insert package popularity", "INSERT OR REPLACE INTO package2popularity (version, package, popularity) VALUES (?, ?, ?)", &db.insertPackagePopularityStmt},
 		{"get package by version, repo and file path", `SELECT f2p.package FROM file2package AS f2p LEFT JOIN package2popularity AS p2p
 								ON f2p.version = p2p.version
 									AND f2p.package = p2p.package
 								WHERE f2p.version = ?
-									AND f2p.path = ?
-								ORDER BY p2p.popularity ASC`, &db.getPackageByFilepathVersionStmt},
+									AND f2p.dir = ?
+									AND f2p.name = ?
+								ORDER BY p2p.popularity ASC NULLS LAST`, &db.getPackageByFilepathVersionStmt},
 		{"get package by version and file name", `SELECT f2p.package FROM file2package AS f2p LEFT JOIN package2popularity AS p2p
 								ON f2p.version = p2p.version
 									AND f2p.package = p2p.package
 								WHERE f2p.version = ?
-									AND f2p.path LIKE ?
-								ORDER BY p2p.popularity ASC`, &db.getPackageByFilenameVersionStmt},
+									AND f2p.dir LIKE ? ESCAPE '\'
+									AND f2p.name = ?
+								ORDER BY p2p.popularity ASC NULLS LAST`, &db.getPackageByFilenameVersionStmt},
+		{"get package by version and path pattern", `SELECT f2p.path, f2p.package FROM file2package AS f2p LEFT JOIN package2popularity AS p2p
+								ON f2p.version = p2p.version
+									AND f2p.package = p2p.package
+								WHERE f2p.version = ?
+									AND f2p.path LIKE ? ESCAPE '\'
+								ORDER BY p2p.popularity ASC NULLS LAST`, &db.getPackageByPathLikeStmt},
+		{"get files of package", `SELECT DISTINCT path FROM file2package
+								WHERE version = ? AND package = ? AND (? = '' OR arch = ?) AND (? = '' OR repo = ?)
+								ORDER BY path`, &db.getFilesOfPackageStmt},
 		{"get package popularity", "SELECT popularity FROM package2popularity WHERE version = ? AND package = ?", &db.getPopularityByPackageStmt},
-		{"remove all packages of version, repo", "DELETE FROM file2package WHERE version = ? AND arch = ? AND repo = ?", &db.removeAllPackagesStmt},
+		{"remove all packages of version, repo", "DELETE FROM file WHERE suite_id IN (SELECT id FROM suite WHERE version = ? AND arch = ? AND repo = ?)", &db.removeAllPackagesStmt},
 		{"remove all packageinfos of version, repo and arch", "DELETE FROM packageinfo WHERE version = ? AND repo = ? AND arch = ?", &db.removeAllPackageInfosStmt},
 		{"remove all popcons of version", "DELETE FROM package2popularity WHERE version = ?", &db.removeAllPopularitiesStmt},
+		{"remove package file", `DELETE FROM file WHERE id IN (SELECT id FROM file2package
+								WHERE version = ? AND arch = ? AND repo = ? AND dir = ? AND name = ? AND package = ?)`, &db.removePackageFileStmt},
+		{"remove package info", "DELETE FROM packageinfo WHERE version = ? AND repo = ? AND arch = ? AND package = ? AND package_version = ?", &db.removePackageInfoStmt},
 		{"list packages by version, arch and repo", "SELECT path, package FROM file2package WHERE version = ? AND arch = ? AND repo = ?", &db.getPackagesStmt},
-		{"get package info", "SELECT filename FROM packageinfo WHERE version = ? AND arch = ? AND package = ?", &db.getPackageInfoStmt},
+		{"get package info", "SELECT package_version, filename, control FROM packageinfo WHERE version = ? AND arch = ? AND package = ?", &db.getPackageInfoStmt},
+		{"set release", "INSERT OR REPLACE INTO release (version, updated, content, signature) VALUES (?, ?, ?, ?)", &db.setReleaseStmt},
+		{"get release", "SELECT updated, content, signature FROM release WHERE version = ?", &db.getReleaseStmt},
+		{"insert relation", `INSERT OR REPLACE INTO relation (version, repo, arch, package, package_version, field, alternative, position,
+									name, arch_qualifier, op, rel_version, arches, profiles)
+								VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, &db.insertRelationStmt},
+		{"get relations of package", `SELECT field, alternative, name, arch_qualifier, op, rel_version, arches, profiles FROM relation
+								WHERE version = ? AND arch = ? AND package = ? AND package_version = ?
+								ORDER BY field, alternative, position`, &db.getRelationsStmt},
+		{"get relations to package", `SELECT package, package_version, field, name, arch_qualifier, op, rel_version, arches, profiles FROM relation
+								WHERE version = ? AND arch = ? AND name = ?
+								ORDER BY package, field`, &db.getReverseRelationsStmt},
+		{"remove relations of package", "DELETE FROM relation WHERE version = ? AND arch = ? AND package = ? AND package_version = ?", &db.removeRelationsStmt},
+		{"remove all relations of version, repo and arch", "DELETE FROM relation WHERE version = ? AND repo = ? AND arch = ?", &db.removeAllRelationsStmt},
+	}
+
+	if db.pathIndex {
+		stmts = append(stmts, []stmtDefinition{
+			{"insert path into index", "INSERT INTO file_fts (rowid, path) VALUES (?, ?)", &db.insertPathIndexStmt},
+			{"remove all paths of version, arch and repo from index", `DELETE FROM file_fts WHERE rowid IN (SELECT id FROM file
+								WHERE suite_id IN (SELECT id FROM suite WHERE version = ? AND arch = ? AND repo = ?))`, &db.removeAllPathIndexStmt},
+			{"remove path from index", `DELETE FROM file_fts WHERE rowid IN (SELECT id FROM file2package
+								WHERE version = ? AND arch = ? AND repo = ? AND dir = ? AND name = ? AND package = ?)`, &db.removePathIndexStmt},
+			{"get package by version and indexed substring", `SELECT f2p.path, f2p.package FROM file_fts JOIN file2package AS f2p
+								ON f2p.id = file_fts.rowid
+								LEFT JOIN package2popularity AS p2p
+								ON f2p.version = p2p.version
+									AND f2p.package = p2p.package
+								WHERE f2p.version = ?
+									AND file_fts MATCH ?
+								ORDER BY p2p.popularity ASC NULLS LAST`, &db.getPackageByPathMatchStmt},
+		}...)
 	}
 
-	var err error
 	for _, s := range stmts {
-		stmt := db.newStmt(s.name, s.stmtStr)
-		*s.stmt = stmt
+		stmt, err := db.newStmt(s.name, s.stmtStr)
 		if err != nil {
-			panic(s.name + ": could not prepare statement: " + err.Error())
+			return err
 		}
+		*s.stmt = stmt
+	}
 
+	db.suites = internTable{insert: db.insertSuiteStmt, get: db.getSuiteStmt}
+	db.packages = internTable{insert: db.insertPackageStmt, get: db.getPackageIDStmt}
+	db.dirs = internTable{insert: db.insertDirStmt, get: db.getDirStmt}
+
+	return nil
+}
+
+func (db *SqliteDb) RemoveAllPackageInfos(ctx context.Context, version, repo, arch string) error {
+	_, err := db.removeAllPackageInfosStmt.Exec(ctx, version, repo, arch)
+	if err != nil {
+		return err
 	}
 
+	_, err = db.removeAllRelationsStmt.Exec(ctx, version, repo, arch)
+
+	return err
 }
 
-func (db *SqliteDb) removeAllPackageInfos(version, repo, arch string) {
-	db.removeAllPackageInfosStmt.Exec(version, repo, arch)
+func (db *SqliteDb) RemoveAllPackages(ctx context.Context, version, arch, repo string) error {
+	// the index is looked up by the ids of the files
+	if db.pathIndex {
+		_, err := db.removeAllPathIndexStmt.Exec(ctx, version, arch, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.removeAllPackagesStmt.Exec(ctx, version, arch, repo)
+
+	return err
 }
 
-func (db *SqliteDb) removeAllPackages(version, arch, repo string) {
-	db.removeAllPackagesStmt.Exec(version, arch, repo)
+func (db *SqliteDb) RemoveAllPopularities(ctx context.Context, version string) error {
+	_, err := db.removeAllPopularitiesStmt.Exec(ctx, version)
+
+	return err
 }
 
-func (db *SqliteDb) removeAllPopularities(version string) {
-	db.removeAllPopularitiesStmt.Exec(version)
+func (db *SqliteDb) RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	dir, name := splitPath(path)
+
+	if db.pathIndex {
+		_, err := db.removePathIndexStmt.Exec(ctx, version, arch, repo, dir, name, filePackage)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.removePackageFileStmt.Exec(ctx, version, arch, repo, dir, name, filePackage)
+
+	return err
 }
 
-func (db *SqliteDb) getPackageInfo(version, arch, pkg string) PackageInfo {
+func (db *SqliteDb) RemovePackageInfo(ctx context.Context, version, repo, arch, pkg, pkgVersion string) error {
+	_, err := db.removePackageInfoStmt.Exec(ctx, version, repo, arch, pkg, pkgVersion)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.removeRelationsStmt.Exec(ctx, version, arch, pkg, pkgVersion)
+
+	return err
+}
+
+func (db *SqliteDb) GetPackageInfo(ctx context.Context, version, arch, pkg string) (PackageInfo, error) {
 	var pi PackageInfo
 
-	rows := db.getPackageInfoStmt.Query(version, arch, pkg)
+	rows, err := db.getPackageInfoStmt.Query(ctx, version, arch, pkg)
+	if err != nil {
+		return pi, err
+	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return pi
+	// the newest version wins if several versions of pkg are indexed
+	versions := storedVersions{pkg: pkg}
+	for rows.Next() {
+		var pkgVersion, filename string
+		var control sql.NullString
+		err = rows.Scan(&pkgVersion, &filename, &control)
+		if err != nil {
+			return pi, err
+		}
+		versions.add(pkgVersion, filename, control.String)
 	}
+	if err := rows.Err(); err != nil {
+		return pi, err
+	}
+	rows.Close()
 
-	var filename string
-	err := rows.Scan(&filename)
+	pi, err = versions.newest()
 	if err != nil {
-		panic(err)
+		return pi, err
 	}
 
-	pi.Version = version
-	pi.Name = pkg
-	pi.Filename = filename
+	err = db.getRelations(ctx, version, arch, &pi)
 
-	return pi
+	return pi, err
 }
 
-func (db *SqliteDb) getPackagePopularity(version, pkg string) uint {
-	rows := db.getPopularityByPackageStmt.Query(version, pkg)
+func (db *SqliteDb) GetPackagePopularity(ctx context.Context, version, pkg string) (uint, error) {
+	rows, err := db.getPopularityByPackageStmt.Query(ctx, version, pkg)
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return 0
+		return 0, rows.Err()
 	}
 
 	var popularity uint
-	err := rows.Scan(&popularity)
+	err = rows.Scan(&popularity)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	return popularity
+	return popularity, nil
 }
 
-func (db *SqliteDb) getPackageByX(version, path string, s *stmt) []string {
+func (db *SqliteDb) getPackageByX(ctx context.Context, version string, s *stmt, dir, name string) ([]string, error) {
 	var filePackages []string
 
-	rows := s.Query(version, path)
+	rows, err := s.Query(ctx, version, dir, name)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var filePackage string
 		err := rows.Scan(&filePackage)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		filePackages = append(filePackages, filePackage)
 	}
 
-	return filePackages
+	return filePackages, rows.Err()
 }
 
 func createPackagesSqlFmtString(count int) string {
@@ -222,61 +428,121 @@ func createPackagesSqlFmtString(count int) string {
 
 	inStr = strings.TrimRight(inStr, ", ")
 
+	// the directories and names let the lookup use the indices
 	sqlStr := fmt.Sprintf(`SELECT f2p.path, f2p.package FROM file2package AS f2p LEFT JOIN package2popularity AS p2p
 									ON f2p.version = p2p.version
 										AND f2p.package = p2p.package
 									WHERE f2p.version = ?
+										AND f2p.dir IN (%s)
+										AND f2p.name IN (%s)
 										AND f2p.path IN (%s)
-									ORDER BY p2p.popularity ASC`, inStr)
+									ORDER BY p2p.popularity ASC NULLS LAST`, inStr, inStr, inStr)
 
 	return sqlStr
 
 }
-func (db *SqliteDb) getPackages(version string, paths []string) map[string][]string {
-	ret := make(map[string][]string)
 
-	for _, splitPaths := range split(paths, 1000) {
-		stmt := db.newStmt("get packages", createPackagesSqlFmtString(len(splitPaths)))
-		pathsInterface := make([]interface{}, len(splitPaths)+1)
-		pathsInterface[0] = version
-		for i := range splitPaths {
-			pathsInterface[i+1] = splitPaths[i]
-		}
-		rows := stmt.Query(pathsInterface...)
+func (db *SqliteDb) getPackagesOfPaths(ctx context.Context, version string, paths []string, ret map[string][]string) error {
+	stmt, err := db.newStmt("get packages", createPackagesSqlFmtString(len(paths)))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	pathsInterface := make([]interface{}, 3*len(paths)+1)
+	pathsInterface[0] = version
+	for i := range paths {
+		dir, name := splitPath(paths[i])
+		pathsInterface[i+1] = dir
+		pathsInterface[len(paths)+i+1] = name
+		pathsInterface[2*len(paths)+i+1] = paths[i]
+	}
+	rows, err := stmt.Query(ctx, pathsInterface...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		defer rows.Close()
+	for rows.Next() {
+		var path string
+		var pkg string
 
-		for rows.Next() {
-			var path string
-			var pkg string
+		err := rows.Scan(&path, &pkg)
+		if err != nil {
+			return err
+		}
 
-			err := rows.Scan(&path, &pkg)
-			if err != nil {
-				panic(err)
-			}
+		ret[path] = append(ret[path], pkg)
+	}
 
-			if ret[path] == nil {
-				ret[path] = make([]string, 0)
-			}
+	return rows.Err()
+}
 
-			ret[path] = append(ret[path], pkg)
+func (db *SqliteDb) GetPackages(ctx context.Context, version string, paths []string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+
+	for _, splitPaths := range split(paths, 1000) {
+		err := db.getPackagesOfPaths(ctx, version, splitPaths, ret)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return ret
+	return ret, nil
 }
 
-func (db *SqliteDb) getPackage(version, path string) []string {
+func (db *SqliteDb) GetPackage(ctx context.Context, version, path string) ([]string, error) {
 	if strings.HasPrefix(path, "/") {
-		return db.getPackageByX(version, path, db.getPackageByFilepathVersionStmt)
+		dir, name := splitPath(path)
+		return db.getPackageByX(ctx, version, db.getPackageByFilepathVersionStmt, dir, name)
+	}
+
+	// the directories of relative paths may have any prefix
+	dirPattern := "%"
+	dir, name := splitPath("/" + path)
+	if dir != "" {
+		dirPattern = "%" + escapeLike(dir)
+	}
+	return db.getPackageByX(ctx, version, db.getPackageByFilenameVersionStmt, dirPattern, name)
+}
+
+// getPackagesMatching returns the packages of the paths selected by m; the
+// path index is used if the literal has at least the three characters of a
+// trigram.
+func (db *SqliteDb) GetPackagesMatching(ctx context.Context, version string, m PathMatcher) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if db.pathIndex && utf8.RuneCountInString(m.Literal) >= 3 {
+		rows, err = db.getPackageByPathMatchStmt.Query(ctx, version, ftsPhrase(m.Literal))
 	} else {
-		path = fmt.Sprintf("%%/%s", path)
-		return db.getPackageByX(version, path, db.getPackageByFilenameVersionStmt)
+		rows, err = db.getPackageByPathLikeStmt.Query(ctx, version, "%"+escapeLike(m.Literal)+"%")
+	}
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var filePackages []string
+	for rows.Next() {
+		var path, filePackage string
+		err := rows.Scan(&path, &filePackage)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Match(path) {
+			filePackages = append(filePackages, filePackage)
+		}
+	}
+
+	return filePackages, rows.Err()
 }
 
-func (db *SqliteDb) walk(version, arch, repo string, walker func(path, pkg string) bool) {
-	rows := db.getPackagesStmt.Query(version, arch, repo)
+func (db *SqliteDb) Walk(ctx context.Context, version, arch, repo string, walker func(path, pkg string) bool) error {
+	rows, err := db.getPackagesStmt.Query(ctx, version, arch, repo)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
@@ -285,115 +551,512 @@ func (db *SqliteDb) walk(version, arch, repo string, walker func(path, pkg strin
 
 		err := rows.Scan(&path, &pkg)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		ret := walker(path, pkg)
 		if !ret {
-			return
+			return nil
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *SqliteDb) GetFiles(ctx context.Context, version, pkg, arch, repo string) ([]string, error) {
+	rows, err := db.getFilesOfPackageStmt.Query(ctx, version, pkg, arch, arch, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, rows.Err()
+}
+
+func (db *SqliteDb) InsertPackageInfo(ctx context.Context, version, repo string, arch string, pkginfo PackageInfo) error {
+	_, err := db.insertPackageInfoStmt.Exec(ctx, version, repo, pkginfo.Name, pkginfo.Version, arch, pkginfo.Filename,
+		pkginfo.Architecture, pkginfo.Source, pkginfo.Section, pkginfo.Priority, pkginfo.Maintainer, pkginfo.InstalledSize, pkginfo.Size,
+		pkginfo.SHA256, pkginfo.MD5sum, pkginfo.Homepage, pkginfo.MultiArch, pkginfo.Description, pkginfo.LongDescription,
+		formatRelations(pkginfo.Depends), formatRelations(pkginfo.PreDepends), formatRelations(pkginfo.Recommends),
+		formatRelations(pkginfo.Suggests), formatRelations(pkginfo.Conflicts), formatRelations(pkginfo.Breaks),
+		formatRelations(pkginfo.Replaces), formatRelations(pkginfo.Provides), formatRelations(pkginfo.Enhances),
+		pkginfo.Fields.String())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.removeRelationsStmt.Exec(ctx, version, arch, pkginfo.Name, pkginfo.Version)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range RelationFields {
+		for i, alternatives := range pkginfo.Relations(field) {
+			for j, r := range alternatives {
+				_, err = db.insertRelationStmt.Exec(ctx, version, repo, arch, pkginfo.Name, pkginfo.Version, field, i, j,
+					r.Name, r.ArchQualifier, r.Op, r.Version, strings.Join(r.Arches, " "), formatProfiles(r.Profiles))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *SqliteDb) GetReverseRelations(ctx context.Context, version, arch, name string) ([]ReverseDependency, error) {
+	rows, err := db.getReverseRelationsStmt.Query(ctx, version, arch, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []ReverseDependency
+	for rows.Next() {
+		var rd ReverseDependency
+		var arches, profiles string
+		err = rows.Scan(&rd.Package, &rd.Version, &rd.Field, &rd.Relation.Name, &rd.Relation.ArchQualifier, &rd.Relation.Op, &rd.Relation.Version, &arches, &profiles)
+		if err != nil {
+			return nil, err
 		}
+		rd.Relation = storedRelation(rd.Relation, arches, profiles)
+		relations = append(relations, rd)
 	}
+
+	return relations, rows.Err()
 }
 
-func (db *SqliteDb) insertPackageInfo(version, repo string, arch string, pkginfo PackageInfo) {
-	db.insertPackageInfoStmt.Exec(version, repo, pkginfo.Name, pkginfo.Version, arch, pkginfo.Filename)
+// getRelations sets the relation fields of pi to the relations stored for
+// the package.
+func (db *SqliteDb) getRelations(ctx context.Context, version, arch string, pi *PackageInfo) error {
+	rows, err := db.getRelationsStmt.Query(ctx, version, arch, pi.Name, pi.Version)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	clearRelations(pi)
+	for rows.Next() {
+		var field, arches, profiles string
+		var alternative int
+		var r Relation
+		err = rows.Scan(&field, &alternative, &r.Name, &r.ArchQualifier, &r.Op, &r.Version, &arches, &profiles)
+		if err != nil {
+			return err
+		}
+		addRelation(pi, field, alternative, storedRelation(r, arches, profiles))
+	}
+
+	return rows.Err()
 }
 
-func (db *SqliteDb) insertPackageFile(version, arch, repo, path, filePackage string) {
-	db.insertPackageFileStmt.Exec(version, arch, repo, path, filePackage)
+func (db *SqliteDb) InsertPackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	dir, name := splitPath(path)
+
+	suiteID, err := db.suites.id(ctx, version, arch, repo)
+	if err != nil {
+		return err
+	}
+	dirID, err := db.dirs.id(ctx, dir)
+	if err != nil {
+		return err
+	}
+	packageID, err := db.packages.id(ctx, filePackage)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.insertPackageFileStmt.Exec(ctx, suiteID, dirID, name, packageID)
+	if err != nil || !db.pathIndex {
+		return err
+	}
+
+	// files that are indexed already are ignored
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted == 0 {
+		return err
+	}
+	fileID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.insertPathIndexStmt.Exec(ctx, fileID, path)
+
+	return err
 }
 
-func (db *SqliteDb) insertPackagePopularity(version, pkg string, popularity uint) {
-	db.insertPackagePopularityStmt.Exec(version, pkg, popularity)
+// splitPath splits path after its last slash into the directory, which is
+// interned, and the base name.
+func splitPath(path string) (string, string) {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return "", path
+	}
+
+	return path[:i], path[i+1:]
 }
 
-func (db *SqliteDb) beginTransaction() {
-	if db.inTransaction {
-		return
+// matchesRelativePath reports whether the absolute path matches the relative
+// path rel like in GetPackage: their base names are equal and the directory
+// of path ends with the one of rel, ignoring ASCII case like SQLite's LIKE.
+func matchesRelativePath(path, rel string) bool {
+	dir, name := splitPath(path)
+	relDir, relName := splitPath("/" + rel)
+	if name != relName || len(dir) < len(relDir) {
+		return false
+	}
+
+	suffix := dir[len(dir)-len(relDir):]
+	for i := 0; i < len(suffix); i++ {
+		if lowerASCII(suffix[i]) != lowerASCII(relDir[i]) {
+			return false
+		}
 	}
 
-	_, err := db.db.Exec("BEGIN TRANSACTION")
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
+// internTable looks up the ids of the rows of a table of interned values,
+// inserting missing rows. The ids are cached once they are committed; they
+// stay valid as interned rows are never removed.
+type internTable struct {
+	sync.Mutex
+	ids    map[string]int64
+	insert *stmt
+	get    *stmt
+}
+
+func (t *internTable) id(ctx context.Context, values ...interface{}) (int64, error) {
+	key := fmt.Sprintf("%q", values)
+
+	t.Lock()
+	id, ok := t.ids[key]
+	t.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	tx := t.insert.db.txOf(ctx)
+	if tx != nil {
+		tx.Lock()
+		id, ok = tx.ids[t][key]
+		tx.Unlock()
+		if ok {
+			return id, nil
+		}
+	}
+
+	_, err := t.insert.Exec(ctx, values...)
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+
+	rows, err := t.get.Query(ctx, values...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: interned %s", ErrNotFound, key)
+	}
+
+	err = rows.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	// ids of rows inserted by a transaction vanish if it is rolled back
+	if tx != nil {
+		tx.Lock()
+		if tx.ids[t] == nil {
+			tx.ids[t] = make(map[string]int64)
+		}
+		tx.ids[t][key] = id
+		tx.Unlock()
+	} else {
+		t.cache(map[string]int64{key: id})
+	}
+
+	return id, nil
+}
+
+// cache adds committed ids to the cache.
+func (t *internTable) cache(ids map[string]int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ids == nil {
+		t.ids = make(map[string]int64)
+	}
+	for key, id := range ids {
+		t.ids[key] = id
 	}
+}
 
-	db.inTransaction = true
+// ftsPhrase quotes s as FTS5 phrase; with the trigram tokenizer it matches
+// the texts containing s, ignoring case.
+func ftsPhrase(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
 
-func (db *SqliteDb) endTransaction() {
-	if !db.inTransaction {
-		return
+func (db *SqliteDb) InsertPackagePopularity(ctx context.Context, version, pkg string, popularity uint) error {
+	_, err := db.insertPackagePopularityStmt.Exec(ctx, version, pkg, popularity)
+
+	return err
+}
+
+func (db *SqliteDb) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if db.txOf(ctx) != nil {
+		return f(ctx)
+	}
+
+	// SQLite has a single writer; unlike its busy timeout, waiting here for
+	// long imports of other goroutines doesn't fail
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	t := &sqlTx{db: &db.baseDB, tx: tx, stmts: make(map[*stmt]*sql.Stmt), ids: make(map[*internTable]map[string]int64)}
+	err = f(context.WithValue(ctx, txKey{}, t))
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	db.db.Exec("END TRANSACTION")
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	for table, ids := range t.ids {
+		table.cache(ids)
+	}
+
+	return nil
+}
+
+// LockSuite locks the file next to the database, so processes sharing it
+// import one suite at a time; as SQLite has a single writer, concurrent
+// imports of different suites would only fail waiting for each other.
+func (db *SqliteDb) LockSuite(ctx context.Context, version string) (func(), error) {
+	unlock, err := lockFile(ctx, db.dbPath+".lock")
+	if err != nil {
+		return nil, fmt.Errorf("could not lock db: %w", err)
+	}
 
-	db.inTransaction = false
+	return unlock, nil
 }
 
-func (db *SqliteDb) setContentETag(version, arch, repo, etag string) {
-	db.setContentETagStmt.Exec(version, arch, repo, etag)
+func (db *SqliteDb) SetContentETag(ctx context.Context, version, arch, repo, etag string) error {
+	_, err := db.setContentETagStmt.Exec(ctx, version, arch, repo, etag)
+
+	return err
 }
 
-func (db *SqliteDb) setPackageInfoETag(version, repo, arch, etag string) {
-	db.setPackageInfoETagStmt.Exec(version, repo, arch, etag)
+func (db *SqliteDb) SetPackageInfoETag(ctx context.Context, version, repo, arch, etag string) error {
+	_, err := db.setPackageInfoETagStmt.Exec(ctx, version, repo, arch, etag)
+
+	return err
 }
 
-func (db *SqliteDb) getPackageInfoETag(version, repo, arch string) string {
+func (db *SqliteDb) GetPackageInfoETag(ctx context.Context, version, repo, arch string) (string, error) {
 	var etag string
 
-	rows := db.getPackageInfoETagStmt.Query(version, repo, arch)
+	rows, err := db.getPackageInfoETagStmt.Query(ctx, version, repo, arch)
+	if err != nil {
+		return "", err
+	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return ""
+		return "", rows.Err()
 	}
 
-	err := rows.Scan(&etag)
+	err = rows.Scan(&etag)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return etag
+	return etag, nil
 }
 
-func (db *SqliteDb) getContentETag(version, arch, repo string) string {
+func (db *SqliteDb) GetContentETag(ctx context.Context, version, arch, repo string) (string, error) {
 	var etag string
 
-	rows := db.getContentETagStmt.Query(version, arch, repo)
+	rows, err := db.getContentETagStmt.Query(ctx, version, arch, repo)
+	if err != nil {
+		return "", err
+	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return ""
+		return "", rows.Err()
 	}
 
-	err := rows.Scan(&etag)
+	err = rows.Scan(&etag)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return etag
+	return etag, nil
 }
 
-func (db *SqliteDb) setPopularityETag(version, etag string) {
-	db.setPopularityETagStmt.Exec(version, etag)
+func (db *SqliteDb) SetIndexSHA256(ctx context.Context, version, path, sum string) error {
+	_, err := db.setIndexSHA256Stmt.Exec(ctx, version, path, sum)
+
+	return err
 }
 
-func (db *SqliteDb) getPopularityETag(version string) string {
+func (db *SqliteDb) GetIndexSHA256(ctx context.Context, version, path string) (string, error) {
+	var sum string
+
+	rows, err := db.getIndexSHA256Stmt.Query(ctx, version, path)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", rows.Err()
+	}
+
+	err = rows.Scan(&sum)
+	if err != nil {
+		return "", err
+	}
+
+	return sum, nil
+}
+
+func (db *SqliteDb) SetPopularityETag(ctx context.Context, version, etag string) error {
+	_, err := db.setPopularityETagStmt.Exec(ctx, version, etag)
+
+	return err
+}
+
+func (db *SqliteDb) SetRelease(ctx context.Context, version string, updated time.Time, content, signature []byte) error {
+	_, err := db.setReleaseStmt.Exec(ctx, version, updated.Unix(), content, signature)
+
+	return err
+}
+
+func (db *SqliteDb) GetRelease(ctx context.Context, version string) (time.Time, []byte, []byte, error) {
+	rows, err := db.getReleaseStmt.Query(ctx, version)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return time.Time{}, nil, nil, err
+		}
+		return time.Time{}, nil, nil, fmt.Errorf("%w: release of %s", ErrNotFound, version)
+	}
+
+	var updated int64
+	var content, signature []byte
+	err = rows.Scan(&updated, &content, &signature)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+
+	return time.Unix(updated, 0), content, signature, nil
+}
+
+func (db *SqliteDb) GetPopularityETag(ctx context.Context, version string) (string, error) {
 	var etag string
 
-	rows := db.getPopularityETagStmt.Query(version)
+	rows, err := db.getPopularityETagStmt.Query(ctx, version)
+	if err != nil {
+		return "", err
+	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return ""
+		return "", rows.Err()
 	}
 
-	err := rows.Scan(&etag)
+	err = rows.Scan(&etag)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return etag
+	return etag, nil
+}
+
+// Stats describes the size of the indexed files of a database.
+type Stats struct {
+	// Size is the size of the database file in bytes.
+	Size     int64
+	Files    int64
+	Suites   int64
+	Packages int64
+	Dirs     int64
+	// FlatSize is the number of bytes the version, arch, repo, path and
+	// package strings took when every file stored them. InternedSize is the
+	// number of bytes of the interned strings, the base names and the ids of
+	// the files, counting 4 bytes per id.
+	FlatSize     int64
+	InternedSize int64
+}
+
+// Stats returns the size of the database and how much the interned layout
+// of the files saves.
+func (db *SqliteDb) Stats(ctx context.Context) (Stats, error) {
+	var st Stats
+	var pageCount, pageSize, suiteSize, packageSize, dirSize, fileSize int64
+
+	for _, q := range []struct {
+		query string
+		dest  []interface{}
+	}{
+		{"PRAGMA page_count", []interface{}{&pageCount}},
+		{"PRAGMA page_size", []interface{}{&pageSize}},
+		{"SELECT count(*), coalesce(sum(length(version) + length(arch) + length(repo) + length(path) + length(package)), 0) FROM file2package",
+			[]interface{}{&st.Files, &st.FlatSize}},
+		{"SELECT count(*), coalesce(sum(length(version) + length(arch) + length(repo) + 4), 0) FROM suite", []interface{}{&st.Suites, &suiteSize}},
+		{"SELECT count(*), coalesce(sum(length(name) + 4), 0) FROM package", []interface{}{&st.Packages, &packageSize}},
+		{"SELECT count(*), coalesce(sum(length(path) + 4), 0) FROM dir", []interface{}{&st.Dirs, &dirSize}},
+		{"SELECT coalesce(sum(length(name) + 4 * 4), 0) FROM file", []interface{}{&fileSize}},
+	} {
+		err := db.db.QueryRowContext(ctx, q.query).Scan(q.dest...)
+		if err != nil {
+			return st, fmt.Errorf("%s failed: %w", q.query, err)
+		}
+	}
+
+	st.Size = pageCount * pageSize
+	st.InternedSize = suiteSize + packageSize + dirSize + fileSize
+
+	return st, nil
 }
 
 func split(arr []string, splitLen int) [][]string {
@@ -1,12 +1,20 @@
 package godebian
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestETag(t *testing.T) {
+	ctx := context.Background()
 	dbfh, err := os.CreateTemp("/var/tmp", "aptfs-test-db-*")
 	if err != nil {
 		panic(err)
@@ -20,12 +28,18 @@ func TestETag(t *testing.T) {
 
 	d.dbPath = filename
 
-	d.Open()
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	d.setContentETag("stable", "amd64", "contrib", "bar")
-	d.setContentETag("stable", "amd64", "contrib", "foo")
+	d.SetContentETag(ctx, "stable", "amd64", "contrib", "bar")
+	d.SetContentETag(ctx, "stable", "amd64", "contrib", "foo")
 
-	et := d.getContentETag("stable", "amd64", "contrib")
+	et, err := d.GetContentETag(ctx, "stable", "amd64", "contrib")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if et != "foo" {
 		t.Fatalf("Setting and retrieving etag failed, should be foo, but is: %s", et)
@@ -33,6 +47,7 @@ func TestETag(t *testing.T) {
 }
 
 func TestPackages(t *testing.T) {
+	ctx := context.Background()
 	dbfh, err := os.CreateTemp("/var/tmp", "aptfs-test-db-*")
 	if err != nil {
 		panic(err)
@@ -46,22 +61,29 @@ func TestPackages(t *testing.T) {
 
 	d.dbPath = filename
 
-	d.Open()
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	d.beginTransaction()
-	for i := 0; i < 10; i++ {
-		for j := 0; j <= i; j++ {
-			packageName := fmt.Sprintf("package-%d-%d", i, j)
-			packageFile := fmt.Sprintf("/usr/%d/file", i)
+	d.Transaction(ctx, func(ctx context.Context) error {
+		for i := 0; i < 10; i++ {
+			for j := 0; j <= i; j++ {
+				packageName := fmt.Sprintf("package-%d-%d", i, j)
+				packageFile := fmt.Sprintf("/usr/%d/file", i)
 
-			d.insertPackageFile("stable", "amd64", "main", packageFile, packageName)
+				d.InsertPackageFile(ctx, "stable", "amd64", "main", packageFile, packageName)
+			}
 		}
-	}
-	d.endTransaction()
+		return nil
+	})
 
 	for i := 0; i < 10; i++ {
 		packageFile := fmt.Sprintf("/usr/%d/file", i)
-		ps := d.getPackage("stable", packageFile)
+		ps, err := d.GetPackage(ctx, "stable", packageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(ps) != i+1 {
 			t.Fatalf("%s should have %d packages, but is %+v", packageFile, i+1, ps)
 		}
@@ -69,7 +91,10 @@ func TestPackages(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		packageFile := fmt.Sprintf("%d/file", i)
-		ps := d.getPackage("stable", packageFile)
+		ps, err := d.GetPackage(ctx, "stable", packageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(ps) != i+1 {
 			t.Fatalf("%s should have %d packages, but is %+v", packageFile, i+1, ps)
 		}
@@ -77,6 +102,7 @@ func TestPackages(t *testing.T) {
 }
 
 func TestPackageWalk(t *testing.T) {
+	ctx := context.Background()
 	dbfh, err := os.CreateTemp("/var/tmp", "aptfs-test-db-*")
 	if err != nil {
 		panic(err)
@@ -90,15 +116,228 @@ func TestPackageWalk(t *testing.T) {
 
 	d.dbPath = filename
 
-	d.Open()
-	d.insertPackageFile("stable", "amd64", "main", "/usr/bin/foo", "foo")
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/bin/foo", "foo")
 
-	d.walk("stable", "amd64", "main", func(path, pkg string) bool {
+	err = d.Walk(ctx, "stable", "amd64", "main", func(path, pkg string) bool {
 		if path != "/usr/bin/foo" || pkg != "foo" {
 			t.Errorf("path should be /usr/bin/foo but is %s; pkg should be foo, but is %s", path, pkg)
 		}
 		return true
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackageInfoRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDb(t)
+
+	p, err := NewDeb822Reader(strings.NewReader(testPackages)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := packageInfoFromParagraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageInfo(ctx, "stable", "main", "amd64", pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := d.GetPackageInfo(ctx, "stable", "amd64", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != "1:2.0-1" || stored.Size != 4711 || stored.Fields.Value("X-Custom") != "kept" {
+		t.Errorf("stored package info should be complete, but is %+v", stored)
+	}
+	if formatRelations(stored.Depends) != formatRelations(pi.Depends) {
+		t.Errorf("stored Depends should be %s, but are %s", formatRelations(pi.Depends), formatRelations(stored.Depends))
+	}
+
+	var relations int
+	err = d.db.QueryRow("SELECT COUNT(*) FROM relation WHERE package = ? AND field = ?", "foo", "Depends").Scan(&relations)
+	if err != nil || relations != 4 {
+		t.Errorf("relation table should have 4 Depends of foo, but has %d (%v)", relations, err)
+	}
+
+	var description string
+	err = d.db.QueryRow("SELECT description FROM packageinfo WHERE package = ?", "foo").Scan(&description)
+	if err != nil || description != "tool to foo" {
+		t.Errorf("description column should be set, but is %q (%v)", description, err)
+	}
+}
+
+func TestGetNewestPackageInfo(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDb(t)
+
+	for _, version := range []string{"1.0-1", "1.0~rc1-1", "1.0-1+b1"} {
+		err := d.InsertPackageInfo(ctx, "stable", "main", "amd64", PackageInfo{Name: "foo", Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pi, err := d.GetPackageInfo(ctx, "stable", "amd64", "foo")
+	if err != nil || pi.Version != "1.0-1+b1" {
+		t.Errorf("newest version of foo should be 1.0-1+b1, but is %q (%v)", pi.Version, err)
+	}
+}
+
+func TestOpenAddsPackageInfoColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	old, err := sql.Open(sqliteDriver, sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE packageinfo (version VARCHAR, repo VARCHAR, package VARCHAR, package_version VARCHAR, arch VARCHAR, filename VARCHAR,
+		PRIMARY KEY(version, package, package_version, arch))`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.InsertPackageInfo(context.Background(), "stable", "main", "amd64", PackageInfo{Name: "foo", Version: "1.0", Section: "utils"})
+	if err != nil {
+		t.Fatalf("inserting into migrated table failed: %v", err)
+	}
+}
+
+func TestOpenMigratesFlatFiles(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	old, err := sql.Open(sqliteDriver, sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE file2package (version VARCHAR, arch VARCHAR, repo VARCHAR, path VARCHAR, package VARCHAR, PRIMARY KEY(version, arch, repo, path, package));
+		CREATE INDEX file2package_path_idx ON file2package(path);
+		INSERT INTO file2package VALUES ('debian/stable', 'amd64', 'main', '/usr/bin/ls', 'coreutils'),
+			('debian/stable', 'amd64', 'main', '/usr/bin/cp', 'coreutils'),
+			('debian/stable', 'amd64', 'main', '/bin/sh', 'dash'),
+			('debian/stable', 'all', 'main', '/usr/share/doc/dash/copyright', 'dash')`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"/usr/bin/ls": "coreutils", "sh": "dash", "doc/dash/copyright": "dash", "bin/cp": "coreutils", "in/cp": ""} {
+		pkgs, err := d.GetPackage(ctx, "debian/stable", path)
+		if err != nil || strings.Join(pkgs, " ") != expected {
+			t.Errorf("%s should belong to %q, but belongs to %v (%v)", path, expected, pkgs, err)
+		}
+	}
+
+	files, err := d.GetFiles(ctx, "debian/stable", "dash", "", "")
+	if err != nil || strings.Join(files, " ") != "/bin/sh /usr/share/doc/dash/copyright" {
+		t.Errorf("unexpected files of dash %v (%v)", files, err)
+	}
+
+	st, err := d.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Files != 4 || st.Suites != 2 || st.Packages != 2 || st.Dirs != 3 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// the flat table is replaced by the view
+	err = d.InsertPackageFile(ctx, "debian/stable", "amd64", "main", "/usr/bin/mv", "coreutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := d.GetPackage(ctx, "debian/stable", "/usr/bin/mv")
+	if err != nil || strings.Join(pkgs, " ") != "coreutils" {
+		t.Errorf("/usr/bin/mv should belong to coreutils, but belongs to %v (%v)", pkgs, err)
+	}
+}
+
+func TestPathIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	d := SqliteDb{dbPath: path}
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.pathIndex {
+		if hasFTS5 {
+			t.Fatal("no path index although SQLite was built with FTS5")
+		}
+		t.Skip("SQLite was built without FTS5")
+	}
+
+	for _, f := range [][2]string{{"/usr/lib/libssl.so.3", "libssl3"}, {"/usr/share/doc/libssl3/copyright", "libssl3"}, {"/usr/lib/libssl.so", "libssl-dev"}} {
+		err = d.InsertPackageFile(ctx, "stable", "amd64", "main", f[0], f[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files that are indexed already must not be indexed twice
+	err = d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/lib/libssl.so", "libssl-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, _ := newPathMatcher("LIBSSL.so", SearchOptions{Mode: SearchSubstring, IgnoreCase: true})
+	pkgs, err := d.GetPackagesMatching(ctx, "stable", m)
+	sort.Strings(pkgs)
+	if err != nil || strings.Join(pkgs, " ") != "libssl-dev libssl3" {
+		t.Errorf("indexed search should return libssl3 and libssl-dev, but returned %v (%v)", pkgs, err)
+	}
+
+	err = d.RemovePackageFile(ctx, "stable", "amd64", "main", "/usr/lib/libssl.so", "libssl-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err = d.GetPackagesMatching(ctx, "stable", m)
+	if err != nil || strings.Join(pkgs, " ") != "libssl3" {
+		t.Errorf("removed file should not be found anymore, but search returned %v (%v)", pkgs, err)
+	}
+
+	// databases created without the index are indexed when opened
+	_, err = d.db.Exec("DROP TABLE file_fts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.Close()
+	d = SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err = d.GetPackagesMatching(ctx, "stable", m)
+	if err != nil || strings.Join(pkgs, " ") != "libssl3" {
+		t.Errorf("reopened database should find libssl3, but search returned %v (%v)", pkgs, err)
+	}
+
+	err = d.RemoveAllPackages(ctx, "stable", "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err = d.GetPackagesMatching(ctx, "stable", m)
+	if err != nil || len(pkgs) != 0 {
+		t.Errorf("no packages should be found after removing all, but search returned %v (%v)", pkgs, err)
+	}
 }
 
 func TestCreatePackagesSqlFmtString(t *testing.T) {
@@ -170,3 +409,351 @@ func TestSplitStringArray(t *testing.T) {
 		}
 	}
 }
+
+// testDbConformance checks the behavior all implementations of Db share.
+func testDbConformance(t *testing.T, d Db) {
+	ctx := context.Background()
+
+	err := d.SetContentETag(ctx, "stable", "amd64", "main", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if et, err := d.GetContentETag(ctx, "stable", "amd64", "main"); err != nil || et != "foo" {
+		t.Errorf("content etag should be foo, but is %q (%v)", et, err)
+	}
+	if et, err := d.GetPopularityETag(ctx, "stable"); err != nil || et != "" {
+		t.Errorf("unset popularity etag should be empty, but is %q (%v)", et, err)
+	}
+
+	err = d.SetIndexSHA256(ctx, "stable", "main/Contents-amd64", "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetIndexSHA256(ctx, "stable", "main/Contents-amd64", "bbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := d.GetIndexSHA256(ctx, "stable", "main/Contents-amd64"); err != nil || sum != "bbbb" {
+		t.Errorf("index SHA256 should be bbbb, but is %q (%v)", sum, err)
+	}
+	if sum, err := d.GetIndexSHA256(ctx, "stable", "main/binary-amd64/Packages"); err != nil || sum != "" {
+		t.Errorf("unset index SHA256 should be empty, but is %q (%v)", sum, err)
+	}
+
+	err = d.Transaction(ctx, func(ctx context.Context) error {
+		for _, f := range []struct{ repo, path, pkg string }{
+			{"main", "/usr/bin/ls", "coreutils"},
+			{"main", "/usr/bin/lsblk", "util-linux"},
+			{"main", "/usr/share/doc/coreutils/copyright", "coreutils"},
+			{"main", "/usr/sbin/sendmail", "exim4"},
+			{"main", "/usr/sbin/sendmail", "postfix"},
+			{"contrib", "/usr/bin/foo", "foo"},
+		} {
+			err := d.InsertPackageFile(ctx, "stable", "amd64", f.repo, f.path, f.pkg)
+			if err != nil {
+				return err
+			}
+		}
+		for pkg, rank := range map[string]uint{"postfix": 1, "coreutils": 2} {
+			err := d.InsertPackagePopularity(ctx, "stable", pkg, rank)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/usr/bin/ls":   "coreutils",
+		"bin/ls":        "coreutils",
+		"BIN/ls":        "coreutils",
+		"bin/LS":        "",
+		"/USR/bin/ls":   "",
+		"ls":            "coreutils",
+		"sendmail":      "postfix exim4",
+		"/usr/bin/none": "",
+	} {
+		pkgs, err := d.GetPackage(ctx, "stable", path)
+		if err != nil || strings.Join(pkgs, " ") != want {
+			t.Errorf("packages of %s should be %q, but are %v (%v)", path, want, pkgs, err)
+		}
+	}
+
+	packages, err := d.GetPackages(ctx, "stable", []string{"/usr/bin/ls", "/usr/sbin/sendmail", "/usr/bin/none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(packages); s != "map[/usr/bin/ls:[coreutils] /usr/sbin/sendmail:[postfix exim4]]" {
+		t.Errorf("unexpected packages of paths: %s", s)
+	}
+
+	m, err := newPathMatcher("/usr/bin/ls*", SearchOptions{Mode: SearchGlob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := d.GetPackagesMatching(ctx, "stable", m)
+	sort.Strings(pkgs)
+	if err != nil || strings.Join(pkgs, " ") != "coreutils util-linux" {
+		t.Errorf("packages matching /usr/bin/ls* should be coreutils and util-linux, but are %v (%v)", pkgs, err)
+	}
+
+	files, err := d.GetFiles(ctx, "stable", "coreutils", "", "")
+	if err != nil || strings.Join(files, " ") != "/usr/bin/ls /usr/share/doc/coreutils/copyright" {
+		t.Errorf("unexpected files of coreutils: %v (%v)", files, err)
+	}
+	if files, err := d.GetFiles(ctx, "stable", "coreutils", "amd64", "contrib"); err != nil || len(files) != 0 {
+		t.Errorf("coreutils should have no files in contrib, but has %v (%v)", files, err)
+	}
+
+	var walked []string
+	err = d.Walk(ctx, "stable", "amd64", "contrib", func(path, pkg string) bool {
+		walked = append(walked, path+" "+pkg)
+		return true
+	})
+	if err != nil || strings.Join(walked, ", ") != "/usr/bin/foo foo" {
+		t.Errorf("walking contrib should yield /usr/bin/foo, but yields %v (%v)", walked, err)
+	}
+	walked = nil
+	err = d.Walk(ctx, "stable", "amd64", "main", func(path, pkg string) bool {
+		walked = append(walked, path)
+		return false
+	})
+	if err != nil || len(walked) != 1 {
+		t.Errorf("walking should stop once the walker returns false, but walked %v (%v)", walked, err)
+	}
+
+	err = d.RemovePackageFile(ctx, "stable", "amd64", "main", "/usr/sbin/sendmail", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "stable", "/usr/sbin/sendmail"); err != nil || strings.Join(pkgs, " ") != "exim4" {
+		t.Errorf("sendmail should only be in exim4 after removing it from postfix, but is in %v (%v)", pkgs, err)
+	}
+	err = d.RemoveAllPackages(ctx, "stable", "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "stable", "ls"); err != nil || len(pkgs) != 0 {
+		t.Errorf("ls should be gone after removing main, but is in %v (%v)", pkgs, err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "stable", "foo"); err != nil || len(pkgs) != 1 {
+		t.Errorf("removing main should keep contrib, but foo is in %v (%v)", pkgs, err)
+	}
+
+	if rank, err := d.GetPackagePopularity(ctx, "stable", "postfix"); err != nil || rank != 1 {
+		t.Errorf("rank of postfix should be 1, but is %d (%v)", rank, err)
+	}
+	err = d.RemoveAllPopularities(ctx, "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rank, err := d.GetPackagePopularity(ctx, "stable", "postfix"); err != nil || rank != 0 {
+		t.Errorf("rank of postfix should be 0 after removing all, but is %d (%v)", rank, err)
+	}
+
+	p, err := NewDeb822Reader(strings.NewReader(testPackages)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := packageInfoFromParagraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{"1.0-1", pi.Version} {
+		pi.Version = version
+		err = d.InsertPackageInfo(ctx, "stable", "main", "amd64", pi)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, err := d.GetPackageInfo(ctx, "stable", "amd64", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != "1:2.0-1" || stored.Size != 4711 || formatRelations(stored.Depends) != formatRelations(pi.Depends) {
+		t.Errorf("newest package info of foo should be the stored one, but is %+v", stored)
+	}
+
+	rdeps, err := d.GetReverseRelations(ctx, "stable", "amd64", "libbaz1")
+	if s := formatReverseDependencies(rdeps); err != nil || s != "foo Depends libbaz1, foo Depends libbaz1" {
+		t.Errorf("both versions of foo should depend on libbaz1, but reverse relations are %q (%v)", s, err)
+	}
+	err = d.RemovePackageInfo(ctx, "stable", "main", "amd64", "foo", "1.0-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdeps, err = d.GetReverseRelations(ctx, "stable", "amd64", "libbaz1")
+	if err != nil || len(rdeps) != 1 || rdeps[0].Version != "1:2.0-1" || rdeps[0].Relation.Name != "libbaz1" {
+		t.Errorf("removing foo 1.0-1 should keep the relations of 1:2.0-1, but they are %+v (%v)", rdeps, err)
+	}
+	err = d.RemoveAllPackageInfos(ctx, "stable", "main", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetPackageInfo(ctx, "stable", "amd64", "foo"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("foo should not be found after removing all package infos, but error is %v", err)
+	}
+	if rdeps, err := d.GetReverseRelations(ctx, "stable", "amd64", "libbaz1"); err != nil || len(rdeps) != 0 {
+		t.Errorf("reverse relations should be gone with the package infos, but are %+v (%v)", rdeps, err)
+	}
+
+	if _, _, _, err := d.GetRelease(ctx, "stable"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing release should not be found, but error is %v", err)
+	}
+	updated := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	err = d.SetRelease(ctx, "stable", updated, []byte("Suite: stable\n"), []byte("signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotUpdated, content, signature, err := d.GetRelease(ctx, "stable")
+	if err != nil || !gotUpdated.Equal(updated) || string(content) != "Suite: stable\n" || string(signature) != "signature" {
+		t.Errorf("release should be stored, but is %v %q %q (%v)", gotUpdated, content, signature, err)
+	}
+	err = d.SetRelease(ctx, "stable", updated, []byte("Suite: stable\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, signature, err := d.GetRelease(ctx, "stable"); err != nil || signature != nil {
+		t.Errorf("signature should be removed, but is %q (%v)", signature, err)
+	}
+}
+
+func TestSqliteDbConformance(t *testing.T) {
+	testDbConformance(t, newTestDb(t))
+}
+
+func TestOpenEnablesWAL(t *testing.T) {
+	d := newTestDb(t)
+
+	var mode string
+	err := d.db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if err != nil || mode != "wal" {
+		t.Errorf("journal mode should be wal, but is %q (%v)", mode, err)
+	}
+}
+
+// testDbTransactions checks the isolation and the rollback of the
+// transactions of d.
+func testDbTransactions(t *testing.T, d Db) {
+	ctx := context.Background()
+
+	err := d.Transaction(ctx, func(txCtx context.Context) error {
+		err := d.InsertPackageFile(txCtx, "stable", "amd64", "main", "/usr/bin/foo", "foo")
+		if err != nil {
+			return err
+		}
+
+		// readers of other goroutines neither wait for the transaction
+		// nor see its writes
+		done := make(chan []string)
+		go func() {
+			pkgs, _ := d.GetPackage(ctx, "stable", "/usr/bin/foo")
+			done <- pkgs
+		}()
+		select {
+		case pkgs := <-done:
+			if len(pkgs) != 0 {
+				t.Errorf("uncommitted file should not be visible, but is in %v", pkgs)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("reader should not wait for the transaction")
+		}
+
+		pkgs, err := d.GetPackage(txCtx, "stable", "/usr/bin/foo")
+		if err != nil || len(pkgs) != 1 {
+			t.Errorf("the transaction should see its own file, but it is in %v (%v)", pkgs, err)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "stable", "/usr/bin/foo"); err != nil || len(pkgs) != 1 {
+		t.Errorf("committed file should be visible, but is in %v (%v)", pkgs, err)
+	}
+
+	errFailed := errors.New("failed")
+	err = d.Transaction(ctx, func(ctx context.Context) error {
+		err := d.InsertPackageFile(ctx, "testing", "amd64", "main", "/usr/bin/bar", "bar")
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("transaction should fail with the error of its function, but error is %v", err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "testing", "/usr/bin/bar"); err != nil || len(pkgs) != 0 {
+		t.Errorf("file of rolled back transaction should be gone, but is in %v (%v)", pkgs, err)
+	}
+	// nothing of the rolled back transaction is reused
+	err = d.InsertPackageFile(ctx, "testing", "amd64", "main", "/usr/bin/bar", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs, err := d.GetPackage(ctx, "testing", "/usr/bin/bar"); err != nil || len(pkgs) != 1 {
+		t.Errorf("file inserted after the rollback should be visible, but is in %v (%v)", pkgs, err)
+	}
+
+	// transactions of different goroutines don't interfere
+	errs := make(chan error)
+	for _, version := range []string{"oldstable", "unstable"} {
+		go func() {
+			errs <- d.Transaction(ctx, func(ctx context.Context) error {
+				for i := 0; i < 100; i++ {
+					err := d.InsertPackageFile(ctx, version, "amd64", "main", fmt.Sprintf("/usr/share/%s/%d", version, i), version)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	for _, version := range []string{"oldstable", "unstable"} {
+		if files, err := d.GetFiles(ctx, version, version, "", ""); err != nil || len(files) != 100 {
+			t.Errorf("%s should have 100 files, but has %d (%v)", version, len(files), err)
+		}
+	}
+}
+
+func TestSqliteDbTransactions(t *testing.T) {
+	testDbTransactions(t, newTestDb(t))
+}
+
+func TestSqliteDbLockSuite(t *testing.T) {
+	testSuiteLocker(t, newTestDb(t))
+}
+
+// testSuiteLocker checks that LockSuite waits for the process holding the
+// lock of a suite.
+func testSuiteLocker(t *testing.T, d SuiteLocker) {
+	ctx := context.Background()
+
+	unlock, err := d.LockSuite(ctx, "debian/stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	_, err = d.LockSuite(waitCtx, "debian/stable")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("locking a locked suite should wait, but error is %v", err)
+	}
+
+	unlock()
+	unlock, err = d.LockSuite(ctx, "debian/stable")
+	if err != nil {
+		t.Fatalf("unlocked suite should be locked again, but error is %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,121 @@
+package godebian
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Field is a field of a deb822 paragraph. The value of a multi-line field
+// contains its continuation lines separated by newlines, without the leading
+// space.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Paragraph is a stanza of a deb822 control file, e.g. a package of a
+// Packages file, with its fields in the order of the file.
+type Paragraph []Field
+
+// Value returns the value of the field name, which is matched case
+// insensitively, or "" if the paragraph doesn't have the field.
+func (p Paragraph) Value(name string) string {
+	for _, f := range p {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+
+	return ""
+}
+
+// String returns the paragraph in deb822 format.
+func (p Paragraph) String() string {
+	var sb strings.Builder
+	for _, f := range p {
+		sb.WriteString(f.Name)
+		sb.WriteString(":")
+		for i, line := range strings.Split(f.Value, "\n") {
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+			if line != "" || i > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(line)
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// ParseParagraph parses the lines of a single deb822 paragraph; comment
+// lines are skipped.
+func ParseParagraph(lines []string) (Paragraph, error) {
+	var p Paragraph
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(p) == 0 {
+				return nil, fmt.Errorf("continuation line without field: %q", line)
+			}
+			p[len(p)-1].Value += "\n" + line[1:]
+			continue
+		}
+
+		ss := strings.SplitN(line, ":", 2)
+		if len(ss) != 2 || ss[0] == "" {
+			return nil, fmt.Errorf("invalid line in paragraph: %q", line)
+		}
+		p = append(p, Field{Name: ss[0], Value: strings.TrimSpace(ss[1])})
+	}
+
+	return p, nil
+}
+
+// Deb822Reader reads the paragraphs of a deb822 control file like a Packages
+// or Sources file.
+type Deb822Reader struct {
+	scanner *bufio.Scanner
+}
+
+func NewDeb822Reader(r io.Reader) *Deb822Reader {
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 1024*1024)
+
+	return &Deb822Reader{scanner: scanner}
+}
+
+// Next returns the next paragraph; it returns io.EOF after the last one.
+func (r *Deb822Reader) Next() (Paragraph, error) {
+	var lines []string
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			if len(lines) > 0 {
+				return ParseParagraph(lines)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines) > 0 {
+		return ParseParagraph(lines)
+	}
+
+	return nil, io.EOF
+}
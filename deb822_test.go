@@ -0,0 +1,96 @@
+package godebian
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const testPackages = `# generated for testing
+Package: foo
+Version: 1:2.0-1
+Installed-Size: 120
+Maintainer: Jane Doe <jane@example.org>
+Architecture: amd64
+Depends: libc6 (>= 2.36), libbar1 | libbaz1,
+ libqux2
+Description: tool to foo
+ Foo does things.
+ .
+ It does them well.
+Homepage: https://example.org/foo
+X-Custom: kept
+Size: 4711
+SHA256: 0123456789abcdef
+Filename: pool/main/f/foo/foo_2.0-1_amd64.deb
+
+Package: bar
+Version: 1.0
+Multi-Arch: same
+Provides: bar-api`
+
+func TestDeb822Reader(t *testing.T) {
+	r := NewDeb822Reader(strings.NewReader(testPackages))
+
+	var paragraphs []Paragraph
+	for {
+		p, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		paragraphs = append(paragraphs, p)
+	}
+
+	if len(paragraphs) != 2 {
+		t.Fatalf("expected 2 paragraphs, but got %d", len(paragraphs))
+	}
+
+	foo := paragraphs[0]
+	if foo.Value("package") != "foo" || foo.Value("X-Custom") != "kept" {
+		t.Errorf("unexpected fields %+v", foo)
+	}
+	if foo.Value("Depends") != "libc6 (>= 2.36), libbar1 | libbaz1,\nlibqux2" {
+		t.Errorf("unexpected multi-line Depends %q", foo.Value("Depends"))
+	}
+	if paragraphs[1].Value("Provides") != "bar-api" {
+		t.Errorf("last paragraph without trailing newline should be complete, but is %+v", paragraphs[1])
+	}
+
+	reparsed, err := ParseParagraph(strings.Split(foo.String(), "\n"))
+	if err != nil || reparsed.String() != foo.String() {
+		t.Errorf("paragraph should survive a round trip, but is %q (%v)", reparsed.String(), err)
+	}
+
+	_, err = ParseParagraph([]string{" continuation"})
+	if err == nil {
+		t.Errorf("continuation line without field should fail")
+	}
+}
+
+func TestPackageInfoFromParagraph(t *testing.T) {
+	p, err := NewDeb822Reader(strings.NewReader(testPackages)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi, err := packageInfoFromParagraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Name != "foo" || pi.Version != "1:2.0-1" || pi.Architecture != "amd64" || pi.Maintainer != "Jane Doe <jane@example.org>" {
+		t.Errorf("unexpected package info %+v", pi)
+	}
+	if pi.InstalledSize != 120 || pi.Size != 4711 || pi.SHA256 != "0123456789abcdef" || pi.Homepage != "https://example.org/foo" {
+		t.Errorf("unexpected package info %+v", pi)
+	}
+	if formatRelations(pi.Depends) != "libc6 (>= 2.36), libbar1 | libbaz1, libqux2" {
+		t.Errorf("unexpected Depends %s", formatRelations(pi.Depends))
+	}
+	if pi.Description != "tool to foo" || pi.LongDescription != "Foo does things.\n\nIt does them well." {
+		t.Errorf("unexpected description %q / %q", pi.Description, pi.LongDescription)
+	}
+}
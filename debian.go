@@ -2,42 +2,147 @@ package godebian
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// PackageInfo is a package of a Packages file.
 type PackageInfo struct {
-	Name     string
-	Version  string
-	Depends  []string
-	Filename string
+	Name         string
+	Version      string
+	Architecture string
+	Source       string
+	Section      string
+	Priority     string
+	Maintainer   string
+	// InstalledSize is the estimated disk space of the installed package in
+	// KiB.
+	InstalledSize uint64
+	// Size is the size of the .deb file in bytes.
+	Size      uint64
+	Filename  string
+	SHA256    string
+	MD5sum    string
+	Homepage  string
+	MultiArch string
+	// Description is the synopsis, LongDescription the extended description
+	// with paragraphs separated by empty lines.
+	Description     string
+	LongDescription string
+	Depends         []Alternatives
+	PreDepends      []Alternatives
+	Recommends      []Alternatives
+	Suggests        []Alternatives
+	Conflicts       []Alternatives
+	Breaks          []Alternatives
+	Replaces        []Alternatives
+	Provides        []Alternatives
+	Enhances        []Alternatives
+	// Fields are all fields of the stanza, including unknown ones.
+	Fields Paragraph
 }
 
+// Db stores the indexed data of DebianContents; SqliteDb, MemoryDb, BoltDb
+// and PostgresDb implement it. version is the distro with its version, e.g. "debian/stable",
+// repo a component like "main". Getters return zero values for data that was
+// never set, except those returning ErrNotFound.
 type Db interface {
-	beginTransaction()
-	endTransaction()
-	setContentETag(version, arch, repo, etag string)
-	getContentETag(version, arch, repo string) string
-	setPopularityETag(version, etag string)
-	getPopularityETag(version string) string
-	setPackageInfoETag(version, repo, arch, etag string)
-	getPackageInfoETag(version, repo, arch string) string
-	getPackage(version, path string) []string
-	getPackages(version string, path []string) map[string][]string
-	getPackageInfo(version, arch, pkg string) PackageInfo
-	removeAllPackages(version, arch, repo string)
-	removeAllPackageInfos(version, repo, arch string)
-	removeAllPopularities(version string)
-	insertPackageFile(version, arch, repo, path, filePackage string)
-	insertPackageInfo(version, repo string, arch string, pi PackageInfo)
-	insertPackagePopularity(version, pkg string, popularity uint)
-	walk(version, arch, repo string, walker func(path, pkg string) bool)
-	getPackagePopularity(version, pkg string) uint
+	// Transaction calls f with a context that makes the calls with it a
+	// transaction, which is committed if f returns nil and rolled back
+	// otherwise. Calls with other contexts, e.g. of other goroutines, don't
+	// see its writes before the commit, and transactions started with its
+	// context join it.
+	Transaction(ctx context.Context, f func(ctx context.Context) error) error
+
+	SetContentETag(ctx context.Context, version, arch, repo, etag string) error
+	GetContentETag(ctx context.Context, version, arch, repo string) (string, error)
+	SetPopularityETag(ctx context.Context, version, etag string) error
+	GetPopularityETag(ctx context.Context, version string) (string, error)
+	SetPackageInfoETag(ctx context.Context, version, repo, arch, etag string) error
+	GetPackageInfoETag(ctx context.Context, version, repo, arch string) (string, error)
+	// SetIndexSHA256 records the SHA256 of the uncompressed index file
+	// path, e.g. "main/Contents-amd64", whose content was imported last;
+	// PDiffs are only applied to the index file the database contains.
+	SetIndexSHA256(ctx context.Context, version, path, sum string) error
+	GetIndexSHA256(ctx context.Context, version, path string) (string, error)
+
+	// InsertPackageFile records that filePackage contains the absolute
+	// path; inserting a file twice has no effect.
+	InsertPackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error
+	RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error
+	RemoveAllPackages(ctx context.Context, version, arch, repo string) error
+	// GetPackage returns the packages containing path of all architectures
+	// and repos, most popular first and those without popcon rank last,
+	// possibly several times. Relative paths
+	// match the absolute paths ending with "/" + path; the case of their
+	// directories is ignored for ASCII letters.
+	GetPackage(ctx context.Context, version, path string) ([]string, error)
+	// GetPackages looks up the packages of absolute paths; paths that no
+	// package contains are left out.
+	GetPackages(ctx context.Context, version string, path []string) (map[string][]string, error)
+	// GetPackagesMatching returns the packages of the paths m matches in the
+	// order of GetPackage.
+	GetPackagesMatching(ctx context.Context, version string, m PathMatcher) ([]string, error)
+	// GetFiles returns the sorted paths of pkg; empty arch or repo match
+	// any.
+	GetFiles(ctx context.Context, version, pkg, arch, repo string) ([]string, error)
+	// Walk calls walker for the files of arch and repo until it returns
+	// false. The files are read while walking, so walker must not use the
+	// Db.
+	Walk(ctx context.Context, version, arch, repo string, walker func(path, pkg string) bool) error
+
+	// InsertPackageInfo stores pi, replacing the package info of the same
+	// package version.
+	InsertPackageInfo(ctx context.Context, version, repo string, arch string, pi PackageInfo) error
+	RemovePackageInfo(ctx context.Context, version, repo, arch, pkg, pkgVersion string) error
+	RemoveAllPackageInfos(ctx context.Context, version, repo, arch string) error
+	// GetPackageInfo returns the newest version of pkg or ErrNotFound.
+	GetPackageInfo(ctx context.Context, version, arch, pkg string) (PackageInfo, error)
+	// GetReverseRelations returns the relations of the packages of arch,
+	// including Provides, whose Relation.Name is name.
+	GetReverseRelations(ctx context.Context, version, arch, name string) ([]ReverseDependency, error)
+
+	InsertPackagePopularity(ctx context.Context, version, pkg string, popularity uint) error
+	RemoveAllPopularities(ctx context.Context, version string) error
+	// GetPackagePopularity returns the popcon rank of pkg or 0 if it has
+	// none.
+	GetPackagePopularity(ctx context.Context, version, pkg string) (uint, error)
+
+	// SetRelease stores the Release file content and, unless it is
+	// clearsigned, its detached signature.
+	SetRelease(ctx context.Context, version string, updated time.Time, content, signature []byte) error
+	// GetRelease returns the time, the content and the signature of the
+	// last SetRelease call or ErrNotFound.
+	GetRelease(ctx context.Context, version string) (updated time.Time, content, signature []byte, err error)
+}
+
+// SuiteLocker is implemented by Dbs that several processes can share; it
+// keeps them from updating the same suite at the same time.
+type SuiteLocker interface {
+	// LockSuite waits until no other process updates version or ctx is
+	// done; other processes wait until unlock is called.
+	LockSuite(ctx context.Context, version string) (unlock func(), err error)
+}
+
+// BulkFileInserter is implemented by Dbs that insert the files of a whole
+// Contents file faster at once than one by one with InsertPackageFile.
+type BulkFileInserter interface {
+	// InsertPackageFiles inserts the absolute paths and packages of files
+	// like InsertPackageFile.
+	InsertPackageFiles(ctx context.Context, version, arch, repo string, files iter.Seq2[string, string]) error
 }
 
 type DebianContents struct {
@@ -46,248 +151,862 @@ type DebianContents struct {
 	distroWithVersion string
 	arch              string
 	downloadBaseURL   string
+	distsURL          string
+	release           *Release
+	verification      ReleaseVerification
+	cacheDir          string
+	opts              ContentsOptions
+	lastUpdate        time.Time
 }
 
-type urlWithArch struct {
-	url  string
-	arch string
+// parseContentsLine returns the absolute path and the package names of a
+// line of a Contents file.
+func parseContentsLine(line string) (string, []string, bool) {
+	ss := strings.Fields(line)
+	if len(ss) < 2 {
+		return "", nil, false
+	}
+
+	path := "/" + ss[0]
+	debs := ss[len(ss)-1]
+	var pkgs []string
+	for _, deb := range strings.Split(debs, ",") {
+		pkgPath := strings.Split(deb, "/")
+		pkgs = append(pkgs, pkgPath[len(pkgPath)-1])
+	}
+
+	return path, pkgs, true
 }
 
-func (d *DebianContents) readContentsFileIntoDB(r io.Reader, arch, repo string) {
+func (d *DebianContents) readContentsFileIntoDB(ctx context.Context, r io.Reader, arch, repo string) error {
 	scanner := bufio.NewScanner(r)
-	d.db.beginTransaction()
-	defer d.db.endTransaction()
-	for scanner.Scan() {
-		ss := strings.Fields(scanner.Text())
-		if len(ss) < 2 {
-			continue
+	files := func(yield func(path, pkg string) bool) {
+		for scanner.Scan() {
+			path, pkgs, ok := parseContentsLine(scanner.Text())
+			if !ok {
+				continue
+			}
+			for _, pkg := range pkgs {
+				if !yield(path, pkg) {
+					return
+				}
+			}
 		}
-		path := "/" + ss[0]
-		debs := ss[len(ss)-1]
-		for _, deb := range strings.Split(debs, ",") {
-			pkgPath := strings.Split(deb, "/")
-			pkg := pkgPath[len(pkgPath)-1]
-			d.db.insertPackageFile(d.distroWithVersion, arch, repo, path, pkg)
+	}
+
+	return d.db.Transaction(ctx, func(ctx context.Context) error {
+		if bulk, ok := d.db.(BulkFileInserter); ok {
+			err := bulk.InsertPackageFiles(ctx, d.distroWithVersion, arch, repo, files)
+			if err != nil {
+				return err
+			}
+		} else {
+			for path, pkg := range files {
+				err := d.db.InsertPackageFile(ctx, d.distroWithVersion, arch, repo, path, pkg)
+				if err != nil {
+					return err
+				}
+			}
 		}
+
+		return scanner.Err()
+	})
+}
+
+// ContentsOptions describes which archive NewContents indexes.
+type ContentsOptions struct {
+	// Distro namespaces the indexed data in the database, e.g. "debian".
+	Distro string
+	// MirrorURL is the base URL of the archive, e.g. "http://ftp.debian.org/debian/".
+	// file:// URLs and local paths, e.g. the output directory of apt-mirror,
+	// are supported as well.
+	MirrorURL string
+	Suite     string
+	// Components are the archive areas to index, e.g. "main" and "non-free";
+	// all components listed in the Release file are indexed if it is empty.
+	Components []string
+	// Architectures to index; all architectures listed in the Release file
+	// are indexed if it is empty. The first one that is not "all" is used
+	// for package lookups.
+	Architectures []string
+	// PopconURL is the URL or local path of a popcon by_vote file; popularity
+	// is not updated if it is empty.
+	PopconURL string
+	// Keyring is the path of an OpenPGP keyring, e.g.
+	// /usr/share/keyrings/debian-archive-keyring.gpg, used to verify the
+	// Release file. The signature is not checked if it is empty.
+	Keyring string
+	// CacheDir keeps local copies of the index files that PDiffs are applied
+	// to; it defaults to a godebian directory in the user's cache directory.
+	CacheDir string
+}
+
+// DebianOptions returns the options used by NewDebianContents.
+func DebianOptions(version string) ContentsOptions {
+	return ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     "http://ftp.debian.org/debian/",
+		Suite:         version,
+		Architectures: []string{"amd64", "all"},
+		PopconURL:     "https://popcon.debian.org/by_vote.gz",
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		panic(err)
+// UbuntuOptions returns the options used by NewUbuntuContents.
+func UbuntuOptions(version string) ContentsOptions {
+	return ContentsOptions{
+		Distro:        "ubuntu",
+		MirrorURL:     "http://de.archive.ubuntu.com/ubuntu",
+		Suite:         version,
+		Architectures: []string{"amd64"},
+		PopconURL:     "https://popcon.debian.org/by_vote.gz",
 	}
+}
 
+// NewContents opens the index of the archive described by opts and updates
+// it from the mirror.
+func NewContents(opts ContentsOptions, db Db) (DebianContents, error) {
+	return NewContentsContext(context.Background(), opts, db)
 }
 
-func NewDebianContents(version string, db Db) DebianContents {
-	dc := DebianContents{distroWithVersion: fmt.Sprintf("debian/%s", version), db: db, version: version, arch: "amd64"}
-	dc.downloadBaseURL = "http://ftp.debian.org/debian/"
+// NewContentsContext is like NewContents, but aborts downloading and
+// importing the index files once ctx is done.
+func NewContentsContext(ctx context.Context, opts ContentsOptions, db Db) (DebianContents, error) {
+	dc, err := OpenContents(opts, db)
+	if err != nil {
+		return dc, err
+	}
 
-	contentsURLFmt := "http://ftp.debian.org/debian/dists/%s/%s/Contents-%s.gz"
-	packageInfoFmt := "http://ftp.debian.org/debian/dists/%s/%s/binary-%s/Packages.gz"
+	err = dc.Update(ctx)
 
-	dc.updatePopularity("https://popcon.debian.org/by_vote.gz")
+	return dc, err
+}
 
-	for _, repo := range []string{"main", "non-free"} {
-		for _, arch := range []string{"amd64", "all"} {
-			contentsURL := fmt.Sprintf(contentsURLFmt, dc.version, repo, arch)
-			packageInfo := fmt.Sprintf(packageInfoFmt, dc.version, repo, arch)
+// OpenContents returns the index of the archive described by opts as it has
+// been imported into db before; it doesn't access the mirror. Use Update or
+// UpdateIfStale to import or refresh the index files. The stored Release
+// file is verified with opts.Keyring again, using the stored Release.gpg if
+// it is not clearsigned; if that fails or the Release file has expired,
+// OpenContents returns ErrBadSignature or ErrReleaseExpired together with an
+// index that counts as never updated.
+func OpenContents(opts ContentsOptions, db Db) (DebianContents, error) {
+	dc := DebianContents{distroWithVersion: fmt.Sprintf("%s/%s", opts.Distro, opts.Suite), db: db, version: opts.Suite}
+
+	var err error
+	opts.MirrorURL, err = fileURL(opts.MirrorURL)
+	if err != nil {
+		return dc, err
+	}
+	opts.PopconURL, err = fileURL(opts.PopconURL)
+	if err != nil {
+		return dc, err
+	}
+	dc.downloadBaseURL = opts.MirrorURL
 
-			dc.updateContents(urlWithArch{
-				url:  contentsURL,
-				arch: arch,
-			}, repo)
-			dc.updatePackageInfo(packageInfo, repo, arch)
+	if opts.CacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err == nil {
+			opts.CacheDir = filepath.Join(userCacheDir, "godebian")
 		}
 	}
+	dc.cacheDir = opts.CacheDir
 
-	return dc
+	dc.distsURL, err = url.JoinPath(opts.MirrorURL, "dists", opts.Suite)
+	if err != nil {
+		return dc, err
+	}
+	dc.opts = opts
+
+	err = dc.loadRelease(context.Background())
+
+	return dc, err
 }
 
-func NewUbuntuContents(version string, db Db) DebianContents {
-	dc := DebianContents{distroWithVersion: fmt.Sprintf("ubuntu/%s", version), db: db, version: version, arch: "amd64"}
-	dc.downloadBaseURL = "http://de.archive.ubuntu.com/ubuntu"
+// loadRelease restores the Release file and the time of the last update
+// from the database. The stored Release file is checked like a downloaded
+// one: its signature is verified with the keyring again, so one stored
+// without a signature is rejected if a keyring is set, and an expired one is
+// rejected, in which case the index counts as never updated.
+func (d *DebianContents) loadRelease(ctx context.Context) error {
+	updated, content, signature, err := d.db.GetRelease(ctx, d.distroWithVersion)
+	if errors.Is(err, ErrNotFound) {
+		d.selectArch()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	contentsURLFmt := "http://de.archive.ubuntu.com/ubuntu/dists/%s/Contents-%s.gz"
-	packageInfoFmt := "http://de.archive.ubuntu.com/ubuntu/dists/%s/%s/binary-%s/Packages.gz"
+	release, verification, err := checkRelease(content, signature, d.opts.Keyring, "stored Release file of "+d.distroWithVersion)
+	if err != nil {
+		d.release, d.verification, d.lastUpdate = nil, ReleaseVerification{}, time.Time{}
+	} else {
+		d.release, d.verification, d.lastUpdate = release, verification, updated
+	}
+	d.selectArch()
 
-	dc.updatePopularity("https://popcon.debian.org/by_vote.gz")
+	return err
+}
 
-	contentsURL := fmt.Sprintf(contentsURLFmt, dc.version, dc.arch)
-	dc.updateContents(urlWithArch{
-		url:  contentsURL,
-		arch: dc.arch,
-	}, "")
-	for _, repo := range []string{"main", "multiverse", "universe", "restricted"} {
-		packageInfoURL := fmt.Sprintf(packageInfoFmt, dc.version, repo, dc.arch)
+// untrustedRelease reports whether err rejects the stored Release file,
+// which an update replaces.
+func untrustedRelease(err error) bool {
+	return errors.Is(err, ErrBadSignature) || errors.Is(err, ErrReleaseExpired)
+}
 
-		dc.updatePackageInfo(packageInfoURL, repo, dc.arch)
+// lockSuite keeps other processes sharing the database from updating the
+// suite until unlock is called.
+func (d *DebianContents) lockSuite(ctx context.Context) (unlock func(), err error) {
+	locker, ok := d.db.(SuiteLocker)
+	if !ok {
+		return func() {}, nil
 	}
 
-	return dc
+	return locker.LockSuite(ctx, d.distroWithVersion)
 }
 
-func (d *DebianContents) readPopularityFileIntoDB(r io.Reader) {
-	scanner := bufio.NewScanner(r)
-	d.db.beginTransaction()
-	defer d.db.endTransaction()
-	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "#") {
-			continue
-		}
+// selectArch sets the architecture used for package lookups to the first
+// indexed architecture that is not "all".
+func (d *DebianContents) selectArch() {
+	_, arches := d.indexSelection()
 
-		ss := strings.Fields(scanner.Text())
-		if len(ss) < 2 {
-			continue
+	d.arch = ""
+	for _, arch := range arches {
+		if arch != "all" {
+			d.arch = arch
+			break
 		}
+	}
+}
 
-		pkg := ss[1]
-		popularity, err := strconv.Atoi(ss[0])
-		if err != nil {
-			panic("Could not parse line " + scanner.Text())
+// indexSelection returns the components and architectures to index; they
+// default to the ones listed in the Release file.
+func (d *DebianContents) indexSelection() ([]string, []string) {
+	components := d.opts.Components
+	arches := d.opts.Architectures
+	if d.release != nil {
+		if len(components) == 0 {
+			components = d.release.Components
 		}
+		if len(arches) == 0 {
+			arches = d.release.Architectures
+		}
+	}
+
+	return components, arches
+}
+
+// Update downloads the Release file and refreshes the popularity, Contents
+// and Packages indices from the mirror. The suite is updated in one
+// transaction, so queries never see a partially updated one and a failed
+// update keeps the previous index, ETags and Release file. Processes sharing
+// a database that implements SuiteLocker wait for each other's updates of
+// the suite.
+func (d *DebianContents) Update(ctx context.Context) error {
+	unlock, err := d.lockSuite(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return d.update(ctx)
+}
 
-		d.db.insertPackagePopularity(d.distroWithVersion, pkg, uint(popularity))
+func (d *DebianContents) update(ctx context.Context) error {
+	release, verification, err := fetchRelease(ctx, d.distsURL, d.opts.Keyring)
+	if err != nil {
+		return err
 	}
 
-	if err := scanner.Err(); err != nil {
-		panic(err)
+	// the index files are verified against the new Release file, which is
+	// only kept if the update succeeds
+	oldRelease, oldVerification, oldArch := d.release, d.verification, d.arch
+	d.release, d.verification = release, verification
+	d.selectArch()
+
+	var caches cacheFiles
+	var updated time.Time
+	err = d.db.Transaction(ctx, func(ctx context.Context) error {
+		if d.opts.PopconURL != "" {
+			err := d.updatePopularity(ctx, d.opts.PopconURL)
+			if err != nil {
+				return err
+			}
+		}
+
+		contentsFiles, packagesFiles := d.release.indexFiles(d.indexSelection())
+		for _, f := range contentsFiles {
+			err := d.updateContents(ctx, f.path, f.arch, f.component, &caches)
+			if err != nil {
+				return err
+			}
+		}
+		for _, f := range packagesFiles {
+			err := d.updatePackageInfo(ctx, f.path, f.component, f.arch, &caches)
+			if err != nil {
+				return err
+			}
+		}
+
+		updated = time.Now()
+		return d.db.SetRelease(ctx, d.distroWithVersion, updated, d.release.raw, d.release.signature)
+	})
+	if err != nil {
+		caches.abort()
+		d.release, d.verification, d.arch = oldRelease, oldVerification, oldArch
+		return err
 	}
 
+	// the local copies match the committed index files now
+	caches.commit()
+	d.lastUpdate = updated
+
+	return nil
 }
 
-func (d *DebianContents) updatePopularity(url string) {
-	etag := d.db.getPopularityETag(d.distroWithVersion)
+// UpdateIfStale calls Update if the index has never been updated or its last
+// update is older than maxAge; it returns whether it updated the index. An
+// index another process updated while this one waited for it is not updated
+// again.
+func (d *DebianContents) UpdateIfStale(ctx context.Context, maxAge time.Duration) (bool, error) {
+	if !d.Stale(maxAge) {
+		return false, nil
+	}
 
-	resp := eTagRequest(url, etag)
-	if resp == nil {
-		return
+	unlock, err := d.lockSuite(ctx)
+	if err != nil {
+		return false, err
 	}
+	defer unlock()
 
-	d.db.removeAllPopularities(d.distroWithVersion)
+	// another process may have updated the index while this one waited
+	err = d.loadRelease(ctx)
+	if err != nil && !untrustedRelease(err) {
+		return false, err
+	}
+	if err == nil && !d.Stale(maxAge) {
+		return false, nil
+	}
+
+	return true, d.update(ctx)
+}
+
+// LastUpdate returns the time of the last successful Update, or the zero
+// time if the index has never been updated.
+func (d DebianContents) LastUpdate() time.Time {
+	return d.lastUpdate
+}
+
+// Stale reports whether the index has never been updated or its last update
+// is older than maxAge.
+func (d DebianContents) Stale(maxAge time.Duration) bool {
+	return d.lastUpdate.IsZero() || time.Since(d.lastUpdate) > maxAge
+}
+
+func NewDebianContents(version string, db Db) (DebianContents, error) {
+	return NewContents(DebianOptions(version), db)
+}
+
+func NewUbuntuContents(version string, db Db) (DebianContents, error) {
+	return NewContents(UbuntuOptions(version), db)
+}
+
+func (d *DebianContents) readPopularityFileIntoDB(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+
+	return d.db.Transaction(ctx, func(ctx context.Context) error {
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "#") {
+				continue
+			}
+
+			ss := strings.Fields(scanner.Text())
+			if len(ss) < 2 {
+				continue
+			}
+
+			pkg := ss[1]
+			popularity, err := strconv.Atoi(ss[0])
+			if err != nil {
+				return fmt.Errorf("could not parse line %s: %v", scanner.Text(), err)
+			}
+
+			err = d.db.InsertPackagePopularity(ctx, d.distroWithVersion, pkg, uint(popularity))
+			if err != nil {
+				return err
+			}
+		}
 
-	gzr, err := gzip.NewReader(resp.Body)
+		return scanner.Err()
+	})
+}
+
+func (d *DebianContents) updatePopularity(ctx context.Context, url string) error {
+	etag, err := d.db.GetPopularityETag(ctx, d.distroWithVersion)
 	if err != nil {
-		panic(fmt.Errorf("updating popularity from %s failed: %v", url, err))
+		return err
 	}
 
-	defer gzr.Close()
+	resp, err := eTagRequest(ctx, url, etag)
+	if err != nil || resp == nil {
+		return err
+	}
 	defer resp.Body.Close()
 
-	d.readPopularityFileIntoDB(gzr)
+	zr, err := decompress(resp.Body, url)
+	if err != nil {
+		return fmt.Errorf("updating popularity from %s failed: %v", url, err)
+	}
+	defer zr.Close()
+
+	err = d.db.RemoveAllPopularities(ctx, d.distroWithVersion)
+	if err != nil {
+		return err
+	}
+
+	err = d.readPopularityFileIntoDB(ctx, zr)
+	if err != nil {
+		return fmt.Errorf("updating popularity from %s failed: %w", url, err)
+	}
+
+	return d.db.SetPopularityETag(ctx, d.distroWithVersion, resp.Header.Get("Etag"))
+}
+
+// splitDescription splits the value of a Description field into the
+// synopsis and the extended description.
+func splitDescription(value string) (string, string) {
+	synopsis, long, _ := strings.Cut(value, "\n")
+
+	lines := strings.Split(long, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "." {
+			lines[i] = ""
+		}
+	}
+
+	return synopsis, strings.Join(lines, "\n")
+}
 
-	d.db.setPopularityETag(d.distroWithVersion, resp.Header.Get("Etag"))
+// Relations returns the relations of the relation field name, e.g.
+// "Pre-Depends".
+func (pi PackageInfo) Relations(name string) []Alternatives {
+	relations := pi.relationsOf(name)
+	if relations == nil {
+		return nil
+	}
+
+	return *relations
 }
 
-func setContentFileValue(line, prefix string, value *string) {
-	if *value != "" {
-		return
+// relationsOf returns the field of pi that holds the relations of the field
+// name, or nil if name is not one of RelationFields.
+func (pi *PackageInfo) relationsOf(name string) *[]Alternatives {
+	switch name {
+	case "Depends":
+		return &pi.Depends
+	case "Pre-Depends":
+		return &pi.PreDepends
+	case "Recommends":
+		return &pi.Recommends
+	case "Suggests":
+		return &pi.Suggests
+	case "Conflicts":
+		return &pi.Conflicts
+	case "Breaks":
+		return &pi.Breaks
+	case "Replaces":
+		return &pi.Replaces
+	case "Provides":
+		return &pi.Provides
+	case "Enhances":
+		return &pi.Enhances
 	}
 
-	if strings.HasPrefix(line, prefix) {
-		ss := strings.SplitN(line, ": ", 2)
-		if len(ss) == 2 {
-			*value = ss[1]
+	return nil
+}
+
+// packageInfoFromParagraph returns the package info of a stanza of a
+// Packages file.
+func packageInfoFromParagraph(p Paragraph) (PackageInfo, error) {
+	pi := PackageInfo{
+		Name:         p.Value("Package"),
+		Version:      p.Value("Version"),
+		Architecture: p.Value("Architecture"),
+		Source:       p.Value("Source"),
+		Section:      p.Value("Section"),
+		Priority:     p.Value("Priority"),
+		Maintainer:   p.Value("Maintainer"),
+		Filename:     p.Value("Filename"),
+		SHA256:       p.Value("SHA256"),
+		MD5sum:       p.Value("MD5sum"),
+		Homepage:     p.Value("Homepage"),
+		MultiArch:    p.Value("Multi-Arch"),
+		Fields:       p,
+	}
+	pi.InstalledSize, _ = strconv.ParseUint(p.Value("Installed-Size"), 10, 64)
+	pi.Size, _ = strconv.ParseUint(p.Value("Size"), 10, 64)
+	pi.Description, pi.LongDescription = splitDescription(p.Value("Description"))
+
+	for _, field := range RelationFields {
+		relations, err := ParseRelations(p.Value(field))
+		if err != nil {
+			return pi, fmt.Errorf("invalid %s field of %s: %w", field, pi.Name, err)
 		}
+		*pi.relationsOf(field) = relations
+	}
+
+	return pi, nil
+}
+
+// packageInfoFromStanza returns the package info of the lines of a stanza of
+// a Packages file.
+func packageInfoFromStanza(lines []string) (PackageInfo, error) {
+	p, err := ParseParagraph(lines)
+	if err != nil {
+		return PackageInfo{}, err
 	}
 
+	return packageInfoFromParagraph(p)
+}
+
+func (d *DebianContents) readPackagesFileIntoDB(ctx context.Context, r io.Reader, repo, arch string) error {
+	return d.db.Transaction(ctx, func(ctx context.Context) error {
+		pr := NewDeb822Reader(r)
+		for {
+			p, err := pr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			pi, err := packageInfoFromParagraph(p)
+			if err != nil {
+				return err
+			}
+
+			err = d.db.InsertPackageInfo(ctx, d.distroWithVersion, repo, arch, pi)
+			if err != nil {
+				return err
+			}
+		}
+	})
 }
 
-func (d *DebianContents) updatePackageInfo(url string, repo string, arch string) {
-	etag := d.db.getPackageInfoETag(d.distroWithVersion, repo, arch)
+func (d *DebianContents) updatePackageInfo(ctx context.Context, path string, repo string, arch string, caches *cacheFiles) error {
+	etag, err := d.db.GetPackageInfoETag(ctx, d.distroWithVersion, repo, arch)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		patched, err := d.applyPDiffs(ctx, path, newPackagesPatcher(d, arch, repo), caches)
+		if err != nil || patched {
+			return err
+		}
+	}
+
+	url := d.distsURL + "/" + path
+	resp, err := eTagRequest(ctx, url, etag)
+	if err != nil || resp == nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := d.release.verifyIndexFile(resp.Body, path)
+	if err != nil {
+		return fmt.Errorf("updating package info from %s failed: %w", url, err)
+	}
+	defer f.Close()
+
+	zr, err := decompress(f, path)
+	if err != nil {
+		return fmt.Errorf("updating package info from %s failed: %v", url, err)
+	}
+	defer zr.Close()
+
+	cache, err := d.newCacheFile(path)
+	if err != nil {
+		return err
+	}
+	caches.add(cache)
+
+	err = d.db.RemoveAllPackageInfos(ctx, d.distroWithVersion, repo, arch)
+	if err != nil {
+		return err
+	}
 
-	resp := eTagRequest(url, etag)
-	if resp == nil {
-		return
+	sum := sha256.New()
+	err = d.readPackagesFileIntoDB(ctx, io.TeeReader(zr, io.MultiWriter(cache, sum)), repo, arch)
+	if err != nil {
+		return fmt.Errorf("updating package info from %s failed: %w", url, err)
 	}
 
-	gzr, err := gzip.NewReader(resp.Body)
+	err = d.setIndexSHA256(ctx, path, hex.EncodeToString(sum.Sum(nil)))
 	if err != nil {
-		panic(fmt.Errorf("updating package info from %s failed: %v", url, err))
+		return err
 	}
 
-	d.db.removeAllPackageInfos(d.distroWithVersion, repo, arch)
-	defer gzr.Close()
+	return d.db.SetPackageInfoETag(ctx, d.distroWithVersion, repo, arch, resp.Header.Get("Etag"))
+}
+
+func (d *DebianContents) updateContents(ctx context.Context, path, arch, repo string, caches *cacheFiles) error {
+	etag, err := d.db.GetContentETag(ctx, d.distroWithVersion, arch, repo)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		patched, err := d.applyPDiffs(ctx, path, &contentsPatcher{d: d, arch: arch, repo: repo}, caches)
+		if err != nil || patched {
+			return err
+		}
+	}
+
+	url := d.distsURL + "/" + path
+	resp, err := eTagRequest(ctx, url, etag)
+	if err != nil || resp == nil {
+		return err
+	}
 	defer resp.Body.Close()
 
-	scanner := bufio.NewScanner(gzr)
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
-	var pi PackageInfo
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			d.db.insertPackageInfo(d.distroWithVersion, repo, arch, pi)
-			pi = PackageInfo{}
+	f, err := d.release.verifyIndexFile(resp.Body, path)
+	if err != nil {
+		return fmt.Errorf("updating contents from %s failed: %w", url, err)
+	}
+	defer f.Close()
+
+	zr, err := decompress(f, path)
+	if err != nil {
+		return fmt.Errorf("opening contents file %s failed: %v", url, err)
+	}
+	defer zr.Close()
+
+	cache, err := d.newCacheFile(path)
+	if err != nil {
+		return err
+	}
+	caches.add(cache)
+
+	err = d.db.RemoveAllPackages(ctx, d.distroWithVersion, arch, repo)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.New()
+	err = d.readContentsFileIntoDB(ctx, io.TeeReader(zr, io.MultiWriter(cache, sum)), arch, repo)
+	if err != nil {
+		return fmt.Errorf("updating contents from %s failed: %w", url, err)
+	}
+
+	err = d.setIndexSHA256(ctx, path, hex.EncodeToString(sum.Sum(nil)))
+	if err != nil {
+		return err
+	}
+
+	return d.db.SetContentETag(ctx, d.distroWithVersion, arch, repo, resp.Header.Get("Etag"))
+}
+
+// fetchRelease downloads and parses InRelease, falling back to Release and
+// Release.gpg for archives that don't publish an InRelease file. If keyring
+// is set, a Release file without a valid signature is rejected.
+func fetchRelease(ctx context.Context, distsURL, keyring string) (*Release, ReleaseVerification, error) {
+	data, sig, err := fetchReleaseFiles(ctx, distsURL, keyring != "")
+	if err != nil {
+		return nil, ReleaseVerification{}, err
+	}
+
+	return checkRelease(data, sig, keyring, "Release file of "+distsURL)
+}
+
+// checkRelease parses the Release file data, verifies its signature if
+// keyring is set and rejects it if it has expired; sig is the content of
+// Release.gpg if data is not clearsigned. name describes data in errors.
+func checkRelease(data, sig []byte, keyring, name string) (*Release, ReleaseVerification, error) {
+	var verification ReleaseVerification
+
+	if keyring != "" {
+		kr, err := readKeyring(keyring)
+		if err != nil {
+			return nil, verification, fmt.Errorf("reading keyring %s failed: %v", keyring, err)
 		}
-		setContentFileValue(line, "Package: ", &pi.Name)
-		setContentFileValue(line, "Filename: ", &pi.Filename)
-		setContentFileValue(line, "Version: ", &pi.Version)
-		var deps string
-		setContentFileValue(line, "Depends: ", &deps)
-		if deps != "" {
-			pi.Depends = strings.Split(deps, ", ")
+
+		verification, err = verifyReleaseSignature(kr, data, sig)
+		if err != nil {
+			return nil, verification, fmt.Errorf("verifying %s failed: %w", name, err)
 		}
 	}
-	if scanner.Err() != nil {
-		panic(scanner.Err())
+
+	rel, err := ParseRelease(bytes.NewReader(data))
+	if err != nil {
+		return nil, verification, fmt.Errorf("parsing %s failed: %v", name, err)
+	}
+	rel.signature = sig
+
+	verification.ValidUntil = rel.ValidUntil
+	if !rel.ValidUntil.IsZero() && time.Now().After(rel.ValidUntil) {
+		return nil, verification, fmt.Errorf("%w: %s was valid until %s", ErrReleaseExpired, name, rel.ValidUntil)
 	}
 
-	d.db.setPackageInfoETag(d.distroWithVersion, repo, arch, resp.Header.Get("Etag"))
+	return rel, verification, nil
 }
 
-func (d *DebianContents) updateContents(urls urlWithArch, repo string) {
-	etag := d.db.getContentETag(d.distroWithVersion, urls.arch, repo)
+// fetchReleaseFiles returns the content of InRelease, or of Release and, if
+// withSignature is set, Release.gpg.
+func fetchReleaseFiles(ctx context.Context, distsURL string, withSignature bool) ([]byte, []byte, error) {
+	data, err := httpGet(ctx, distsURL+"/InRelease")
+	if err == nil {
+		return data, nil, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, nil, err
+	}
 
-	resp := eTagRequest(urls.url, etag)
-	if resp == nil {
-		return
+	data, err = httpGet(ctx, distsURL+"/Release")
+	if err != nil {
+		return nil, nil, err
 	}
-	d.db.removeAllPackages(d.distroWithVersion, urls.arch, repo)
 
-	gzr, err := gzip.NewReader(resp.Body)
+	if !withSignature {
+		return data, nil, nil
+	}
+
+	sig, err := httpGet(ctx, distsURL+"/Release.gpg")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, sig, nil
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		panic(fmt.Errorf("Opening content file failed: %+v, req: url: %s, resp: %+v", err, urls.url, resp))
+		return nil, err
 	}
 
-	defer gzr.Close()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, requestError(ctx, err)
+	}
 	defer resp.Body.Close()
 
-	d.readContentsFileIntoDB(gzr, urls.arch, repo)
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(url, resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// statusError returns the error for an unexpected HTTP status.
+func statusError(url string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, url)
+	}
+
+	return fmt.Errorf("%w: fetching %s failed: %s", ErrMirrorUnavailable, url, resp.Status)
+}
+
+// client fetches index files and packages; besides http(s) it supports
+// file:// URLs, so that local mirror trees can be indexed without network
+// access.
+var client = newClient()
+
+// requestError returns the error of a failed request; it is the error of ctx
+// if the request failed because ctx is done.
+func requestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return fmt.Errorf("%w: %v", ErrMirrorUnavailable, err)
+}
+
+func newClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
 
-	d.db.setContentETag(d.distroWithVersion, urls.arch, repo, resp.Header.Get("Etag"))
+	return &http.Client{Transport: t}
 }
 
-func eTagRequest(url string, etag string) *http.Response {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+// fileURL turns a local path into a file:// URL; URLs are returned as is.
+func fileURL(s string) (string, error) {
+	if s == "" || strings.Contains(s, "://") {
+		return s, nil
+	}
+
+	path, err := filepath.Abs(s)
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+// eTagRequest fetches url unless its ETag still matches etag, in which case
+// it returns a nil response.
+func eTagRequest(ctx context.Context, url string, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Set("If-None-Match", etag)
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return nil, requestError(ctx, err)
 	}
 
 	if resp.StatusCode == http.StatusNotModified {
-		return nil
+		resp.Body.Close()
+		return nil, nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err := fmt.Errorf("http request failed: %+v", resp)
-		panic(err)
+		resp.Body.Close()
+		return nil, statusError(url, resp)
 	}
-	return resp
+	return resp, nil
+}
+
+func (d DebianContents) SearchPaths(paths []string) (map[string][]string, error) {
+	return d.SearchPathsContext(context.Background(), paths)
 }
 
-func (d DebianContents) SearchPaths(paths []string) map[string][]string {
-	return d.db.getPackages(d.distroWithVersion, paths)
+// SearchPathsContext is like SearchPaths, but uses ctx for the database queries.
+func (d DebianContents) SearchPathsContext(ctx context.Context, paths []string) (map[string][]string, error) {
+	return d.db.GetPackages(ctx, d.distroWithVersion, paths)
 }
 
-func (d DebianContents) Search(path string) []string {
+// Search returns the packages that ship path. By default path is an absolute
+// path or a file name; opts select other ways of matching paths.
+func (d DebianContents) Search(path string, opts ...SearchOptions) ([]string, error) {
+	return d.SearchContext(context.Background(), path, opts...)
+}
+
+// SearchContext is like Search, but uses ctx for the database query.
+func (d DebianContents) SearchContext(ctx context.Context, path string, opts ...SearchOptions) ([]string, error) {
+	var o SearchOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
 	var ret []string
 	retMap := make(map[string]struct{})
-	pkgs := d.db.getPackage(d.distroWithVersion, path)
+	var pkgs []string
+	var err error
+	if o.Mode == SearchExact {
+		pkgs, err = d.db.GetPackage(ctx, d.distroWithVersion, path)
+	} else {
+		var m PathMatcher
+		m, err = newPathMatcher(path, o)
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err = d.db.GetPackagesMatching(ctx, d.distroWithVersion, m)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	for _, pkg := range pkgs {
 		ss := strings.Split(pkg, "/")
@@ -298,43 +1017,102 @@ func (d DebianContents) Search(path string) []string {
 		ret = append(ret, k)
 	}
 
-	return ret
+	return ret, nil
+}
+
+// PackageInfo returns the info of pkg; the error wraps ErrNotFound if the
+// package is unknown.
+func (d DebianContents) PackageInfo(pkg string) (PackageInfo, error) {
+	return d.PackageInfoContext(context.Background(), pkg)
 }
 
-func (d DebianContents) PackageInfo(pkg string) PackageInfo {
-	return d.db.getPackageInfo(d.distroWithVersion, d.arch, pkg)
+// PackageInfoContext is like PackageInfo, but uses ctx for the database query.
+func (d DebianContents) PackageInfoContext(ctx context.Context, pkg string) (PackageInfo, error) {
+	return d.db.GetPackageInfo(ctx, d.distroWithVersion, d.arch, pkg)
 }
 
-func (d DebianContents) Extract(pkg string, filter func(fp io.Reader, fi FileInfo)) {
-	url := d.PackageURL(pkg)
-	if url == "" {
-		return
+func (d DebianContents) Extract(pkg string, filter func(fp io.Reader, fi FileInfo)) error {
+	return d.ExtractContext(context.Background(), pkg, filter)
+}
+
+// ExtractContext is like Extract, but aborts the download once ctx is done.
+func (d DebianContents) ExtractContext(ctx context.Context, pkg string, filter func(fp io.Reader, fi FileInfo)) error {
+	url, err := d.PackageURLContext(ctx, pkg)
+	if err != nil {
+		return err
 	}
 
 	e := extractor{}
 	e.extractFunc = filter
-	e.extract(url)
+	return e.extract(ctx, url)
 }
 
-func (d DebianContents) PackageURL(pkg string) string {
-	pi := d.db.getPackageInfo(d.distroWithVersion, d.arch, pkg)
+func (d DebianContents) PackageURL(pkg string) (string, error) {
+	return d.PackageURLContext(context.Background(), pkg)
+}
 
-	if pi.Filename == "" {
-		return ""
+// PackageURLContext is like PackageURL, but uses ctx for the database query.
+func (d DebianContents) PackageURLContext(ctx context.Context, pkg string) (string, error) {
+	pi, err := d.db.GetPackageInfo(ctx, d.distroWithVersion, d.arch, pkg)
+	if err != nil {
+		return "", err
 	}
 
-	u, err := url.JoinPath(d.downloadBaseURL, pi.Filename)
-	if err != nil {
-		panic(err)
+	if pi.Filename == "" {
+		return "", fmt.Errorf("%w: package %s has no file name", ErrNotFound, pkg)
 	}
 
-	return u
+	return url.JoinPath(d.downloadBaseURL, pi.Filename)
+}
+
+// Release returns the Release file the indexed data was verified against, or
+// nil if the index has never been updated.
+func (d DebianContents) Release() *Release {
+	return d.release
+}
+
+// ReleaseVerification returns how the Release file was authenticated. For an
+// index opened with OpenContents, it is the result of verifying the stored
+// Release file again, see OpenContents.
+func (d DebianContents) ReleaseVerification() ReleaseVerification {
+	return d.verification
+}
+
+// Popularity returns the popcon rank of pkg, or 0 if it is unknown.
+func (d DebianContents) Popularity(pkg string) (uint, error) {
+	return d.PopularityContext(context.Background(), pkg)
+}
+
+// PopularityContext is like Popularity, but uses ctx for the database query.
+func (d DebianContents) PopularityContext(ctx context.Context, pkg string) (uint, error) {
+	return d.db.GetPackagePopularity(ctx, d.distroWithVersion, pkg)
+}
+
+// FileFilter restricts ListFiles to the Contents files of an architecture
+// and a component; empty fields match all of them.
+type FileFilter struct {
+	Arch string
+	Repo string
+}
+
+// ListFiles returns the sorted paths of the files pkg ships, like apt-file
+// list.
+func (d DebianContents) ListFiles(pkg string, filter FileFilter) ([]string, error) {
+	return d.ListFilesContext(context.Background(), pkg, filter)
+}
+
+// ListFilesContext is like ListFiles, but uses ctx for the database query.
+func (d DebianContents) ListFilesContext(ctx context.Context, pkg string, filter FileFilter) ([]string, error) {
+	return d.db.GetFiles(ctx, d.distroWithVersion, pkg, filter.Arch, filter.Repo)
 }
 
-func (d DebianContents) Popularity(pkg string) uint {
-	return d.db.getPackagePopularity(d.distroWithVersion, pkg)
+// Walk calls walker for the files of arch and repo until it returns false;
+// walker must not use d.
+func (d DebianContents) Walk(arch, repo string, walker func(path, pkg string) bool) error {
+	return d.WalkContext(context.Background(), arch, repo, walker)
 }
 
-func (d DebianContents) Walk(arch, repo string, walker func(path, pkg string) bool) {
-	d.db.walk(d.distroWithVersion, arch, repo, walker)
+// WalkContext is like Walk, but stops walking once ctx is done.
+func (d DebianContents) WalkContext(ctx context.Context, arch, repo string, walker func(path, pkg string) bool) error {
+	return d.db.Walk(ctx, d.distroWithVersion, arch, repo, walker)
 }
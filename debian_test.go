@@ -1,24 +1,53 @@
 package godebian
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDebianPackageSearch(t *testing.T) {
 	var d SqliteDb
 
-	d.Open()
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	dc := NewDebianContents("stable", &d)
+	dc, err := NewDebianContents("stable", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
 	testDebianPackageSearch(t, &dc)
 }
 
 func TestUbuntuPackageSearch(t *testing.T) {
 	var d SqliteDb
 
-	d.Open()
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	uc := NewUbuntuContents("focal", &d)
+	uc, err := NewUbuntuContents("focal", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
 	testDebianPackageSearch(t, &uc)
 }
 
@@ -26,7 +55,10 @@ func testDebianPackageSearch(t *testing.T, dc *DebianContents) {
 	find := map[string]bool{"/bin/bash": false, "/usr/share/aqemu/os_templates/Linux": false}
 
 	for path, _ := range find {
-		pks := dc.Search(path)
+		pks, err := dc.Search(path)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(pks) > 0 {
 			find[path] = true
 		}
@@ -38,3 +70,430 @@ func testDebianPackageSearch(t *testing.T, dc *DebianContents) {
 		}
 	}
 }
+
+// testMirror serves a Debian archive from memory; the Release file of each
+// suite is generated from the files below its dists/<suite>/ directory.
+type testMirror struct {
+	files map[string][]byte
+	// tampered is served instead of files without changing the Release file.
+	tampered map[string][]byte
+	status   int
+	requests []string
+	srv      *httptest.Server
+}
+
+func newTestMirror(t *testing.T) *testMirror {
+	m := &testMirror{files: make(map[string][]byte), tampered: make(map[string][]byte)}
+	m.srv = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.srv.Close)
+
+	return m
+}
+
+func (m *testMirror) serve(w http.ResponseWriter, r *http.Request) {
+	m.requests = append(m.requests, r.URL.Path)
+
+	if m.status != 0 {
+		w.WriteHeader(m.status)
+		return
+	}
+
+	content, ok := m.files[r.URL.Path]
+	if strings.HasSuffix(r.URL.Path, "/Release") {
+		content, ok = m.release(strings.TrimSuffix(r.URL.Path, "Release")), true
+	}
+	if tampered, found := m.tampered[r.URL.Path]; found {
+		content = tampered
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	w.Write(content)
+}
+
+func (m *testMirror) release(distsDir string) []byte {
+	var paths []string
+	for path := range m.files {
+		if strings.HasPrefix(path, distsDir) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	buf.WriteString("Suite: stable\nArchitectures: amd64 all\nComponents: main\nSHA256:\n")
+	for _, path := range paths {
+		sum := sha256.Sum256(m.files[path])
+		fmt.Fprintf(&buf, " %s %d %s\n", hex.EncodeToString(sum[:]), len(m.files[path]), strings.TrimPrefix(path, distsDir))
+	}
+
+	return buf.Bytes()
+}
+
+// setGzip stores content gzip compressed at path.
+func (m *testMirror) setGzip(path, content string) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, content)
+	w.Close()
+
+	m.files[path] = buf.Bytes()
+}
+
+func (m *testMirror) requested(path string) bool {
+	for _, r := range m.requests {
+		if r == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTestDb(t *testing.T) *SqliteDb {
+	var d SqliteDb
+
+	d.dbPath = filepath.Join(t.TempDir(), "godebian.sqlite")
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &d
+}
+
+func TestLocalMirrorImport(t *testing.T) {
+	m := &testMirror{files: make(map[string][]byte)}
+	m.setGzip("/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+	m.setGzip("/dists/stable/main/binary-amd64/Packages.gz", "Package: foo\nVersion: 1.0\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\n")
+	m.files["/dists/stable/Release"] = m.release("/dists/stable/")
+	m.files["/by_vote"] = []byte("#rank name inst vote\n1 foo 100 50\n")
+
+	dir := t.TempDir()
+	for path, content := range m.files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, path), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := DebianOptions("stable")
+	opts.MirrorURL = dir
+	opts.PopconURL = filepath.Join(dir, "by_vote")
+	opts.CacheDir = t.TempDir()
+	dc, err := NewContents(opts, newTestDb(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkgs, err := dc.Search("/usr/bin/foo"); err != nil || len(pkgs) != 1 || pkgs[0] != "foo" {
+		t.Errorf("/usr/bin/foo should be in foo, but is in %+v (%v)", pkgs, err)
+	}
+	if pop, err := dc.Popularity("foo"); err != nil || pop != 1 {
+		t.Errorf("popularity of foo should be 1, but is %d (%v)", pop, err)
+	}
+	if u, err := dc.PackageURL("foo"); err != nil || u != "file://"+filepath.ToSlash(dir)+"/pool/main/f/foo/foo_1.0_amd64.deb" {
+		t.Errorf("unexpected package URL %s (%v)", u, err)
+	}
+	if _, err := dc.PackageURL("bar"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown package should not be found, but is: %v", err)
+	}
+}
+
+func TestMirrorErrors(t *testing.T) {
+	m := newTestMirror(t)
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+	m.tampered["/debian/dists/stable/main/Contents-amd64.gz"] = []byte("usr/bin/evil\tutils/evil\n")
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+	db := newTestDb(t)
+
+	_, err := NewContents(opts, db)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("tampered Contents file should fail with checksum mismatch, but is: %v", err)
+	}
+
+	m.status = http.StatusServiceUnavailable
+	_, err = NewContents(opts, db)
+	if !errors.Is(err, ErrMirrorUnavailable) {
+		t.Fatalf("unavailable mirror should fail with ErrMirrorUnavailable, but is: %v", err)
+	}
+}
+
+func TestCanceledImport(t *testing.T) {
+	m := newTestMirror(t)
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewContentsContext(ctx, opts, newTestDb(t))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled import should fail with context.Canceled, but is: %v", err)
+	}
+	if m.requested("/debian/dists/stable/main/Contents-amd64.gz") {
+		t.Fatalf("canceled import should not download index files")
+	}
+}
+
+func TestOpenAndUpdate(t *testing.T) {
+	m := newTestMirror(t)
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+
+	opts := ContentsOptions{
+		Distro:    "debian",
+		MirrorURL: m.srv.URL + "/debian/",
+		Suite:     "stable",
+		CacheDir:  t.TempDir(),
+	}
+	db := newTestDb(t)
+
+	dc, err := OpenContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.requests) != 0 {
+		t.Fatalf("opening the index should not access the mirror, but requested %+v", m.requests)
+	}
+	if !dc.LastUpdate().IsZero() || !dc.Stale(time.Hour) || dc.Release() != nil {
+		t.Fatalf("index should never have been updated, but was updated at %v", dc.LastUpdate())
+	}
+
+	updated, err := dc.UpdateIfStale(context.Background(), time.Hour)
+	if err != nil || !updated {
+		t.Fatalf("stale index should be updated, but is %v (%v)", updated, err)
+	}
+	if dc.Stale(time.Hour) || dc.arch != "amd64" {
+		t.Fatalf("updated index should not be stale and use amd64, but uses %q", dc.arch)
+	}
+
+	m.requests = nil
+	dc, err = OpenContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := dc.UpdateIfStale(context.Background(), time.Hour); err != nil || updated {
+		t.Fatalf("fresh index should not be updated, but is %v (%v)", updated, err)
+	}
+	if len(m.requests) != 0 {
+		t.Fatalf("fresh index should not access the mirror, but requested %+v", m.requests)
+	}
+	if dc.Release() == nil || dc.arch != "amd64" {
+		t.Fatalf("reopened index should know the stored Release file")
+	}
+	if pkgs, err := dc.Search("/usr/bin/foo"); err != nil || len(pkgs) != 1 || pkgs[0] != "foo" {
+		t.Errorf("/usr/bin/foo should be in foo, but is in %+v (%v)", pkgs, err)
+	}
+	if !dc.Stale(0) {
+		t.Errorf("index should be stale with a maximum age of 0")
+	}
+}
+
+// testFailedUpdateKeepsIndex checks that an update failing in its last index
+// file keeps the whole previous index of the suite.
+func testFailedUpdateKeepsIndex(t *testing.T, db Db) {
+	ctx := context.Background()
+	m := newTestMirror(t)
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+	m.setGzip("/debian/dists/stable/main/binary-amd64/Packages.gz", "Package: foo\nVersion: 1.0\n")
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+
+	dc, err := NewContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, err := db.GetContentETag(ctx, "debian/stable", "amd64", "main")
+	if err != nil || etag == "" {
+		t.Fatalf("imported Contents file should have an ETag, but has %q (%v)", etag, err)
+	}
+	_, release, _, err := db.GetRelease(ctx, "debian/stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheSum := filepath.Join(opts.CacheDir, "debian", "stable", "main", "Contents-amd64.gz.sha256")
+	sum, err := os.ReadFile(cacheSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Contents file is imported, but the Release file matches the
+	// truncated Packages file, so the update only fails once its stream
+	// ends early
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/bar\tutils/bar\n")
+	m.setGzip("/debian/dists/stable/main/binary-amd64/Packages.gz", strings.Repeat("Package: bar\nVersion: 1.0\n\n", 1000))
+	content := m.files["/debian/dists/stable/main/binary-amd64/Packages.gz"]
+	m.files["/debian/dists/stable/main/binary-amd64/Packages.gz"] = content[:len(content)/2]
+
+	err = dc.Update(ctx)
+	if err == nil {
+		t.Fatalf("update from a truncated Packages file should fail")
+	}
+
+	if pkgs, err := dc.Search("/usr/bin/foo"); err != nil || len(pkgs) != 1 || pkgs[0] != "foo" {
+		t.Errorf("/usr/bin/foo should still be in foo, but is in %+v (%v)", pkgs, err)
+	}
+	if pkgs, err := dc.Search("/usr/bin/bar"); err != nil || len(pkgs) != 0 {
+		t.Errorf("/usr/bin/bar of the failed update should not be found, but is in %+v (%v)", pkgs, err)
+	}
+	if _, err := dc.PackageInfo("foo"); err != nil {
+		t.Errorf("package info of foo should be kept, but is %v", err)
+	}
+	if newETag, err := db.GetContentETag(ctx, "debian/stable", "amd64", "main"); err != nil || newETag != etag {
+		t.Errorf("failed update should keep ETag %q, but is %q (%v)", etag, newETag, err)
+	}
+	if _, newRelease, _, err := db.GetRelease(ctx, "debian/stable"); err != nil || !bytes.Equal(newRelease, release) {
+		t.Errorf("failed update should keep the Release file (%v)", err)
+	}
+	if newSum, err := os.ReadFile(cacheSum); err != nil || !bytes.Equal(newSum, sum) {
+		t.Errorf("failed update should keep the local copy of the Contents file (%v)", err)
+	}
+}
+
+func TestFailedUpdateKeepsIndex(t *testing.T) {
+	testFailedUpdateKeepsIndex(t, newTestDb(t))
+}
+
+func TestMemoryDbFailedUpdateKeepsIndex(t *testing.T) {
+	testFailedUpdateKeepsIndex(t, NewMemoryDb())
+}
+
+func TestFailedCacheCommit(t *testing.T) {
+	m := newTestMirror(t)
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/foo\tutils/foo\n")
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+	dc, err := NewContents(opts, NewMemoryDb())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in place of the local copy keeps it from being replaced
+	cachePath := filepath.Join(opts.CacheDir, "debian", "stable", "main", "Contents-amd64.gz")
+	err = os.Remove(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(cachePath, "blocked"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", "usr/bin/bar\tutils/bar\n")
+	err = dc.Update(context.Background())
+	if err != nil {
+		t.Fatalf("update should succeed although the local copy can't be replaced, but is %v", err)
+	}
+	if pkgs, err := dc.Search("/usr/bin/bar"); err != nil || len(pkgs) != 1 {
+		t.Errorf("/usr/bin/bar should be found after the update, but is in %+v (%v)", pkgs, err)
+	}
+	if _, err := os.Stat(cachePath + ".sha256"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("local copy that couldn't be replaced should be invalidated, but its SHA256 is there (%v)", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	ctx := context.Background()
+	dc := DebianContents{db: newTestDb(t), distroWithVersion: "debian/stable", arch: "amd64"}
+
+	err := dc.readContentsFileIntoDB(ctx, strings.NewReader("usr/bin/foo\tutils/foo\nusr/share/doc/foo/copyright\tutils/foo,doc/foo-doc\n"), "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dc.readContentsFileIntoDB(ctx, strings.NewReader("usr/bin/foo\tutils/foo\nusr/lib/foo/arm64-only\tutils/foo\n"), "arm64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := dc.ListFiles("foo", FileFilter{})
+	if err != nil || strings.Join(files, " ") != "/usr/bin/foo /usr/lib/foo/arm64-only /usr/share/doc/foo/copyright" {
+		t.Errorf("unexpected files of foo %+v (%v)", files, err)
+	}
+
+	files, err = dc.ListFiles("foo", FileFilter{Arch: "amd64", Repo: "main"})
+	if err != nil || strings.Join(files, " ") != "/usr/bin/foo /usr/share/doc/foo/copyright" {
+		t.Errorf("unexpected amd64 files of foo %+v (%v)", files, err)
+	}
+
+	files, err = dc.ListFiles("foo", FileFilter{Repo: "contrib"})
+	if err != nil || len(files) != 0 {
+		t.Errorf("foo should have no files in contrib, but has %+v (%v)", files, err)
+	}
+}
+
+// bulkMemoryDb is a MemoryDb that inserts files in bulk.
+type bulkMemoryDb struct {
+	*MemoryDb
+	bulkInserts int
+}
+
+func (d *bulkMemoryDb) InsertPackageFiles(ctx context.Context, version, arch, repo string, files iter.Seq2[string, string]) error {
+	d.bulkInserts++
+	for path, pkg := range files {
+		err := d.InsertPackageFile(ctx, version, arch, repo, path, pkg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestBulkFileInsert(t *testing.T) {
+	ctx := context.Background()
+	d := &bulkMemoryDb{MemoryDb: NewMemoryDb()}
+	dc := DebianContents{db: d, distroWithVersion: "debian/stable", arch: "amd64"}
+
+	err := dc.readContentsFileIntoDB(ctx, strings.NewReader("usr/bin/foo\tutils/foo\nusr/share/doc/foo/copyright\tutils/foo,doc/foo-doc\n"), "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.bulkInserts != 1 {
+		t.Errorf("files should be inserted in one bulk insert, but were in %d", d.bulkInserts)
+	}
+
+	pkgs, err := d.GetPackage(ctx, "debian/stable", "/usr/share/doc/foo/copyright")
+	sort.Strings(pkgs)
+	if err != nil || strings.Join(pkgs, " ") != "foo foo-doc" {
+		t.Errorf("copyright should be in foo and foo-doc, but is in %v (%v)", pkgs, err)
+	}
+}
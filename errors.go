@@ -0,0 +1,24 @@
+package godebian
+
+import "errors"
+
+var (
+	// ErrNotFound is returned if a package or a file on the mirror does not
+	// exist.
+	ErrNotFound = errors.New("not found")
+	// ErrChecksumMismatch is returned if a downloaded file does not match
+	// the size or SHA256 listed in the Release file.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrMirrorUnavailable is returned if the mirror can't be reached or
+	// answers with an error.
+	ErrMirrorUnavailable = errors.New("mirror unavailable")
+	// ErrBadSignature is returned if the Release file is not signed by a
+	// key of the configured keyring.
+	ErrBadSignature = errors.New("bad Release file signature")
+	// ErrReleaseExpired is returned if the Valid-Until date of the Release
+	// file has passed.
+	ErrReleaseExpired = errors.New("Release file expired")
+	// ErrSchemaTooNew is returned by Open if the database was written by a
+	// newer version of godebian.
+	ErrSchemaTooNew = errors.New("database schema too new")
+)
@@ -9,7 +9,6 @@ import (
 	"io/fs"
 	"net/http"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/blakesmith/ar"
@@ -29,10 +28,10 @@ type extractor struct {
 	extractFunc func(fp io.Reader, fi FileInfo)
 }
 
-func (e extractor) extractDataFile(r io.Reader, filename string) {
+func (e extractor) extractDataFile(ctx context.Context, r io.Reader, filename string) error {
 	format, input, err := archiver.Identify(filename, r)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	handler := func(ctx context.Context, f archiver.File) error {
@@ -53,7 +52,7 @@ func (e extractor) extractDataFile(r io.Reader, filename string) {
 		if f.Open != nil {
 			fp, err = f.Open()
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 		}
@@ -65,28 +64,34 @@ func (e extractor) extractDataFile(r io.Reader, filename string) {
 
 		e.extractFunc(fp, fi)
 
-		if err != nil && !errors.Is(err, syscall.EPERM) {
-			panic(err)
-		}
-
 		return nil
 	}
 
-	ctx := context.TODO()
-	if ex, ok := format.(archiver.Extractor); ok {
-		ex.Extract(ctx, input, nil, handler)
+	ex, ok := format.(archiver.Extractor)
+	if !ok {
+		return fmt.Errorf("%s is not an archive", filename)
 	}
+
+	return ex.Extract(ctx, input, nil, handler)
 }
 
-func (e extractor) extract(url string) {
-	resp, err := http.Get(url)
+func (e extractor) extract(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	debFile := resp.Body
+	resp, err := client.Do(req)
+	if err != nil {
+		return requestError(ctx, err)
+	}
 	defer resp.Body.Close()
-	deb := ar.NewReader(debFile)
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(url, resp)
+	}
+
+	deb := ar.NewReader(resp.Body)
 
 	for {
 		header, err := deb.Next()
@@ -94,12 +99,15 @@ func (e extractor) extract(url string) {
 			break
 		}
 		if err != nil {
-			fmt.Printf("%T %+v\n", err, err)
-			panic(err)
+			return fmt.Errorf("reading %s failed: %w", url, err)
 		}
 		if strings.HasPrefix(header.Name, "data") {
-			e.extractDataFile(deb, header.Name)
-
+			err = e.extractDataFile(ctx, deb, header.Name)
+			if err != nil {
+				return fmt.Errorf("extracting %s from %s failed: %w", header.Name, url, err)
+			}
 		}
 	}
+
+	return nil
 }
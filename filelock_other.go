@@ -0,0 +1,11 @@
+//go:build !unix
+
+package godebian
+
+import "context"
+
+// lockFile doesn't lock anything on systems without flock(2); processes
+// sharing a database must not update it at the same time there.
+func lockFile(ctx context.Context, path string) (unlock func(), err error) {
+	return func() {}, ctx.Err()
+}
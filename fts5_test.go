@@ -0,0 +1,68 @@
+//go:build sqlite_fts5 || sqlite_purego
+
+package godebian
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hasFTS5 is whether the SQLite driver of this build includes FTS5.
+const hasFTS5 = true
+
+func TestRebuildStalePathIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	d := SqliteDb{dbPath: path}
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/bin/foo", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a build without FTS5 changed the files and left the index stale
+	d.pathIndex = false
+	err = d.RemovePackageFile(ctx, "stable", "amd64", "main", "/usr/bin/foo", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/bin/bar", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.db.Exec(`CREATE TABLE path_index_stale (id INTEGER)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.Close()
+
+	d = SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.db.Close()
+	if !d.pathIndex {
+		t.Fatal("path index should be used with FTS5")
+	}
+
+	m, err := newPathMatcher("bin/", SearchOptions{Mode: SearchSubstring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := d.GetPackagesMatching(ctx, "stable", m)
+	if err != nil || strings.Join(pkgs, " ") != "bar" {
+		t.Errorf("rebuilt path index should find bar only, but finds %v (%v)", pkgs, err)
+	}
+
+	var stale int
+	err = d.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'path_index_stale'`).Scan(&stale)
+	if err != nil || stale != 0 {
+		t.Errorf("path index should not be marked as stale after the rebuild (%v)", err)
+	}
+}
@@ -0,0 +1,606 @@
+package godebian
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDb is a Db that keeps all data in memory, e.g. for tests and tools
+// that don't need to keep an index across runs.
+type MemoryDb struct {
+	// writeMu serializes transactions and writes outside of them
+	writeMu sync.Mutex
+
+	mu    sync.RWMutex
+	state *memState
+}
+
+// memState is the committed data of a MemoryDb or its copy in a
+// transaction.
+type memState struct {
+	etags        map[string]string
+	indexSums    map[string]string
+	files        map[string]map[string]map[fileOwner]bool
+	packageInfos map[string]map[string][]storedPackageInfo
+	rdeps        map[string]map[string][]ReverseDependency
+	popularities map[string]map[string]uint
+	releases     map[string]storedRelease
+
+	// copied are the keys of the maps of a suite that a transaction copied
+	// before changing them; it is nil for the committed data, which owns
+	// all its maps.
+	copied map[string]bool
+}
+
+// memTxKey is the context key of the transaction of a MemoryDb.
+type memTxKey struct{}
+
+// memTx is the transaction of the contexts passed to the function of
+// MemoryDb.Transaction.
+type memTx struct {
+	db *MemoryDb
+
+	mu    sync.RWMutex
+	state *memState
+}
+
+// fileOwner is a package containing a file.
+type fileOwner struct {
+	arch string
+	repo string
+	pkg  string
+}
+
+type storedPackageInfo struct {
+	Repo string
+	Info PackageInfo
+}
+
+type storedRelease struct {
+	updated   time.Time
+	content   []byte
+	signature []byte
+}
+
+// NewMemoryDb returns an empty MemoryDb.
+func NewMemoryDb() *MemoryDb {
+	return &MemoryDb{state: &memState{
+		etags:        make(map[string]string),
+		indexSums:    make(map[string]string),
+		files:        make(map[string]map[string]map[fileOwner]bool),
+		packageInfos: make(map[string]map[string][]storedPackageInfo),
+		rdeps:        make(map[string]map[string][]ReverseDependency),
+		popularities: make(map[string]map[string]uint),
+		releases:     make(map[string]storedRelease),
+	}}
+}
+
+// joinKey joins the parts of a composite map key.
+func joinKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// snapshot returns a copy of s for a transaction; the maps of a suite are
+// only copied once the transaction changes them.
+func (s *memState) snapshot() *memState {
+	return &memState{
+		etags:        maps.Clone(s.etags),
+		indexSums:    maps.Clone(s.indexSums),
+		files:        maps.Clone(s.files),
+		packageInfos: maps.Clone(s.packageInfos),
+		rdeps:        maps.Clone(s.rdeps),
+		popularities: maps.Clone(s.popularities),
+		releases:     maps.Clone(s.releases),
+		copied:       make(map[string]bool),
+	}
+}
+
+// copyOnWrite reports whether the maps of key are shared with the committed
+// data, in which case the caller has to copy them before changing them.
+func (s *memState) copyOnWrite(key string) bool {
+	if s.copied == nil || s.copied[key] {
+		return false
+	}
+	s.copied[key] = true
+
+	return true
+}
+
+// filesOf returns the files of version for changing them.
+func (s *memState) filesOf(version string) map[string]map[fileOwner]bool {
+	if s.copyOnWrite(joinKey("files", version)) {
+		files := make(map[string]map[fileOwner]bool, len(s.files[version]))
+		for path, owners := range s.files[version] {
+			files[path] = maps.Clone(owners)
+		}
+		s.files[version] = files
+	}
+	if s.files[version] == nil {
+		s.files[version] = make(map[string]map[fileOwner]bool)
+	}
+
+	return s.files[version]
+}
+
+// packageInfosOf returns the package infos and the reverse dependencies of
+// the version and architecture joined in k for changing them.
+func (s *memState) packageInfosOf(k string) (map[string][]storedPackageInfo, map[string][]ReverseDependency) {
+	if s.copyOnWrite(joinKey("packageinfos", k)) {
+		s.packageInfos[k] = clipSlices(s.packageInfos[k])
+		s.rdeps[k] = clipSlices(s.rdeps[k])
+	}
+	if s.packageInfos[k] == nil {
+		s.packageInfos[k] = make(map[string][]storedPackageInfo)
+	}
+	if s.rdeps[k] == nil {
+		s.rdeps[k] = make(map[string][]ReverseDependency)
+	}
+
+	return s.packageInfos[k], s.rdeps[k]
+}
+
+// clipSlices copies m; appending to its slices doesn't change those of m.
+func clipSlices[V any](m map[string][]V) map[string][]V {
+	if m == nil {
+		return nil
+	}
+
+	clipped := make(map[string][]V, len(m))
+	for k, v := range m {
+		clipped[k] = slices.Clip(v)
+	}
+
+	return clipped
+}
+
+// popularitiesOf returns the popularities of version for changing them.
+func (s *memState) popularitiesOf(version string) map[string]uint {
+	if s.copyOnWrite(joinKey("popularities", version)) {
+		s.popularities[version] = maps.Clone(s.popularities[version])
+	}
+	if s.popularities[version] == nil {
+		s.popularities[version] = make(map[string]uint)
+	}
+
+	return s.popularities[version]
+}
+
+// txOf returns the transaction of db that ctx belongs to, or nil.
+func (db *MemoryDb) txOf(ctx context.Context) *memTx {
+	tx, ok := ctx.Value(memTxKey{}).(*memTx)
+	if !ok || tx.db != db {
+		return nil
+	}
+
+	return tx
+}
+
+// Transaction calls f with a context whose writes change a copy of the
+// suites they touch, which replaces the data of db if f returns nil. Writes
+// with other contexts wait for the transaction, so f must not make any.
+func (db *MemoryDb) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if db.txOf(ctx) != nil {
+		return f(ctx)
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	tx := &memTx{db: db, state: db.state.snapshot()}
+	err := f(context.WithValue(ctx, memTxKey{}, tx))
+	if err != nil {
+		return err
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.state.copied = nil
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.state = tx.state
+
+	return nil
+}
+
+// read returns the data that the calls with ctx see and the function
+// releasing it.
+func (db *MemoryDb) read(ctx context.Context) (*memState, func()) {
+	if tx := db.txOf(ctx); tx != nil {
+		tx.mu.RLock()
+		return tx.state, tx.mu.RUnlock
+	}
+
+	db.mu.RLock()
+	return db.state, db.mu.RUnlock
+}
+
+// write calls f with the data that the calls with ctx change.
+func (db *MemoryDb) write(ctx context.Context, f func(s *memState)) error {
+	if tx := db.txOf(ctx); tx != nil {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+
+		f(tx.state)
+		return nil
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f(db.state)
+	return nil
+}
+
+func (db *MemoryDb) setETag(ctx context.Context, k, etag string) error {
+	return db.write(ctx, func(s *memState) {
+		s.etags[k] = etag
+	})
+}
+
+func (db *MemoryDb) getETag(ctx context.Context, k string) (string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	return s.etags[k], nil
+}
+
+func (db *MemoryDb) SetContentETag(ctx context.Context, version, arch, repo, etag string) error {
+	return db.setETag(ctx, joinKey("contents", version, arch, repo), etag)
+}
+
+func (db *MemoryDb) GetContentETag(ctx context.Context, version, arch, repo string) (string, error) {
+	return db.getETag(ctx, joinKey("contents", version, arch, repo))
+}
+
+func (db *MemoryDb) SetPopularityETag(ctx context.Context, version, etag string) error {
+	return db.setETag(ctx, joinKey("popularity", version), etag)
+}
+
+func (db *MemoryDb) GetPopularityETag(ctx context.Context, version string) (string, error) {
+	return db.getETag(ctx, joinKey("popularity", version))
+}
+
+func (db *MemoryDb) SetPackageInfoETag(ctx context.Context, version, repo, arch, etag string) error {
+	return db.setETag(ctx, joinKey("packageinfo", version, repo, arch), etag)
+}
+
+func (db *MemoryDb) GetPackageInfoETag(ctx context.Context, version, repo, arch string) (string, error) {
+	return db.getETag(ctx, joinKey("packageinfo", version, repo, arch))
+}
+
+func (db *MemoryDb) SetIndexSHA256(ctx context.Context, version, path, sum string) error {
+	return db.write(ctx, func(s *memState) {
+		s.indexSums[joinKey(version, path)] = sum
+	})
+}
+
+func (db *MemoryDb) GetIndexSHA256(ctx context.Context, version, path string) (string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	return s.indexSums[joinKey(version, path)], nil
+}
+
+func (db *MemoryDb) InsertPackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.write(ctx, func(s *memState) {
+		paths := s.filesOf(version)
+		if paths[path] == nil {
+			paths[path] = make(map[fileOwner]bool)
+		}
+		paths[path][fileOwner{arch: arch, repo: repo, pkg: filePackage}] = true
+	})
+}
+
+func (db *MemoryDb) RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.write(ctx, func(s *memState) {
+		paths := s.filesOf(version)
+		owners := paths[path]
+		delete(owners, fileOwner{arch: arch, repo: repo, pkg: filePackage})
+		if len(owners) == 0 {
+			delete(paths, path)
+		}
+	})
+}
+
+func (db *MemoryDb) RemoveAllPackages(ctx context.Context, version, arch, repo string) error {
+	return db.write(ctx, func(s *memState) {
+		paths := s.filesOf(version)
+		for path, owners := range paths {
+			for owner := range owners {
+				if owner.arch == arch && owner.repo == repo {
+					delete(owners, owner)
+				}
+			}
+			if len(owners) == 0 {
+				delete(paths, path)
+			}
+		}
+	})
+}
+
+// byPopularity sorts pkgs like SqliteDb: the most popular packages first,
+// those without popcon rank last.
+func (s *memState) byPopularity(version string, pkgs []string) []string {
+	popularities := s.popularities[version]
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return rankLess(popularities[pkgs[i]], popularities[pkgs[j]])
+	})
+
+	return pkgs
+}
+
+// rankLess reports whether the popcon rank a comes before b; 0 means
+// unranked and comes last.
+func rankLess(a, b uint) bool {
+	if a == 0 || b == 0 {
+		return a != 0 && b == 0
+	}
+
+	return a < b
+}
+
+// ownerPackages returns the packages of owners in a stable order.
+func ownerPackages(owners map[fileOwner]bool) []string {
+	var sorted []fileOwner
+	for owner := range owners {
+		sorted = append(sorted, owner)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return joinKey(sorted[i].pkg, sorted[i].arch, sorted[i].repo) < joinKey(sorted[j].pkg, sorted[j].arch, sorted[j].repo)
+	})
+
+	pkgs := make([]string, 0, len(sorted))
+	for _, owner := range sorted {
+		pkgs = append(pkgs, owner.pkg)
+	}
+
+	return pkgs
+}
+
+func (db *MemoryDb) GetPackage(ctx context.Context, version, path string) ([]string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	if strings.HasPrefix(path, "/") {
+		return s.byPopularity(version, ownerPackages(s.files[version][path])), nil
+	}
+
+	var pkgs []string
+	for p, owners := range s.files[version] {
+		if matchesRelativePath(p, path) {
+			pkgs = append(pkgs, ownerPackages(owners)...)
+		}
+	}
+	sort.Strings(pkgs)
+
+	return s.byPopularity(version, pkgs), nil
+}
+
+func (db *MemoryDb) GetPackages(ctx context.Context, version string, paths []string) (map[string][]string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	ret := make(map[string][]string)
+	for _, path := range paths {
+		owners := s.files[version][path]
+		if len(owners) > 0 {
+			ret[path] = s.byPopularity(version, ownerPackages(owners))
+		}
+	}
+
+	return ret, nil
+}
+
+func (db *MemoryDb) GetPackagesMatching(ctx context.Context, version string, m PathMatcher) ([]string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	var pkgs []string
+	for path, owners := range s.files[version] {
+		if m.Match(path) {
+			pkgs = append(pkgs, ownerPackages(owners)...)
+		}
+	}
+	sort.Strings(pkgs)
+
+	return s.byPopularity(version, pkgs), nil
+}
+
+func (db *MemoryDb) GetFiles(ctx context.Context, version, pkg, arch, repo string) ([]string, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	var paths []string
+	for path, owners := range s.files[version] {
+		for owner := range owners {
+			if owner.pkg == pkg && (arch == "" || owner.arch == arch) && (repo == "" || owner.repo == repo) {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func (db *MemoryDb) Walk(ctx context.Context, version, arch, repo string, walker func(path, pkg string) bool) error {
+	s, release := db.read(ctx)
+	defer release()
+
+	for path, owners := range s.files[version] {
+		for owner := range owners {
+			if owner.arch != arch || owner.repo != repo {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !walker(path, owner.pkg) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *MemoryDb) InsertPackageInfo(ctx context.Context, version, repo string, arch string, pi PackageInfo) error {
+	return db.write(ctx, func(s *memState) {
+		s.removePackageInfo(version, "", arch, pi.Name, pi.Version)
+
+		infos, rdeps := s.packageInfosOf(joinKey(version, arch))
+		infos[pi.Name] = append(infos[pi.Name], storedPackageInfo{Repo: repo, Info: pi})
+
+		for _, field := range RelationFields {
+			for _, alternatives := range pi.Relations(field) {
+				for _, r := range alternatives {
+					rd := ReverseDependency{Package: pi.Name, Version: pi.Version, Field: field, Relation: r}
+					rdeps[r.Name] = append(rdeps[r.Name], rd)
+				}
+			}
+		}
+	})
+}
+
+// removePackageInfo removes the package info of pkgVersion of pkg and its
+// relations; an empty repo matches any.
+func (s *memState) removePackageInfo(version, repo, arch, pkg, pkgVersion string) {
+	infos, rdeps := s.packageInfosOf(joinKey(version, arch))
+
+	for i, stored := range infos[pkg] {
+		if stored.Info.Version != pkgVersion || (repo != "" && stored.Repo != repo) {
+			continue
+		}
+
+		for _, field := range RelationFields {
+			for _, alternatives := range stored.Info.Relations(field) {
+				for _, r := range alternatives {
+					rdeps[r.Name] = removeReverseDependencies(rdeps[r.Name], pkg, pkgVersion)
+				}
+			}
+		}
+
+		infos[pkg] = append(infos[pkg][:i:i], infos[pkg][i+1:]...)
+		if len(infos[pkg]) == 0 {
+			delete(infos, pkg)
+		}
+		return
+	}
+}
+
+// removeReverseDependencies returns rdeps without the relations of
+// pkgVersion of pkg.
+func removeReverseDependencies(rdeps []ReverseDependency, pkg, pkgVersion string) []ReverseDependency {
+	var kept []ReverseDependency
+	for _, rd := range rdeps {
+		if rd.Package != pkg || rd.Version != pkgVersion {
+			kept = append(kept, rd)
+		}
+	}
+
+	return kept
+}
+
+func (db *MemoryDb) RemovePackageInfo(ctx context.Context, version, repo, arch, pkg, pkgVersion string) error {
+	return db.write(ctx, func(s *memState) {
+		s.removePackageInfo(version, repo, arch, pkg, pkgVersion)
+	})
+}
+
+func (db *MemoryDb) RemoveAllPackageInfos(ctx context.Context, version, repo, arch string) error {
+	return db.write(ctx, func(s *memState) {
+		infos, _ := s.packageInfosOf(joinKey(version, arch))
+		for _, pkgInfos := range infos {
+			for _, stored := range pkgInfos {
+				if stored.Repo == repo {
+					s.removePackageInfo(version, repo, arch, stored.Info.Name, stored.Info.Version)
+				}
+			}
+		}
+	})
+}
+
+func (db *MemoryDb) GetPackageInfo(ctx context.Context, version, arch, pkg string) (PackageInfo, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	var candidates []PackageInfo
+	for _, stored := range s.packageInfos[joinKey(version, arch)][pkg] {
+		candidates = append(candidates, stored.Info)
+	}
+
+	pi, ok := NewestPackageInfo(candidates)
+	if !ok {
+		return pi, fmt.Errorf("%w: package %s", ErrNotFound, pkg)
+	}
+
+	return pi, nil
+}
+
+func (db *MemoryDb) GetReverseRelations(ctx context.Context, version, arch, name string) ([]ReverseDependency, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	rdeps := append([]ReverseDependency(nil), s.rdeps[joinKey(version, arch)][name]...)
+	sortReverseDependencies(rdeps)
+
+	return rdeps, nil
+}
+
+// sortReverseDependencies sorts rdeps by package and field like SqliteDb.
+func sortReverseDependencies(rdeps []ReverseDependency) {
+	sort.SliceStable(rdeps, func(i, j int) bool {
+		if rdeps[i].Package != rdeps[j].Package {
+			return rdeps[i].Package < rdeps[j].Package
+		}
+		return rdeps[i].Field < rdeps[j].Field
+	})
+}
+
+func (db *MemoryDb) InsertPackagePopularity(ctx context.Context, version, pkg string, popularity uint) error {
+	return db.write(ctx, func(s *memState) {
+		s.popularitiesOf(version)[pkg] = popularity
+	})
+}
+
+func (db *MemoryDb) RemoveAllPopularities(ctx context.Context, version string) error {
+	return db.write(ctx, func(s *memState) {
+		delete(s.popularities, version)
+	})
+}
+
+func (db *MemoryDb) GetPackagePopularity(ctx context.Context, version, pkg string) (uint, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	return s.popularities[version][pkg], nil
+}
+
+func (db *MemoryDb) SetRelease(ctx context.Context, version string, updated time.Time, content, signature []byte) error {
+	return db.write(ctx, func(s *memState) {
+		s.releases[version] = storedRelease{updated: updated, content: bytes.Clone(content), signature: bytes.Clone(signature)}
+	})
+}
+
+func (db *MemoryDb) GetRelease(ctx context.Context, version string) (time.Time, []byte, []byte, error) {
+	s, release := db.read(ctx)
+	defer release()
+
+	stored, ok := s.releases[version]
+	if !ok {
+		return time.Time{}, nil, nil, fmt.Errorf("%w: release of %s", ErrNotFound, version)
+	}
+
+	return stored.updated, bytes.Clone(stored.content), bytes.Clone(stored.signature), nil
+}
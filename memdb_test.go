@@ -0,0 +1,63 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryDbConformance(t *testing.T) {
+	testDbConformance(t, NewMemoryDb())
+}
+
+func TestMemoryDbTransactions(t *testing.T) {
+	testDbTransactions(t, NewMemoryDb())
+}
+
+func TestMemoryDbRollbackKeepsPackageInfos(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDb()
+
+	depends, err := ParseRelations("libc6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageInfo(ctx, "stable", "main", "amd64", PackageInfo{Name: "foo", Version: "1.0", Depends: depends})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackagePopularity(ctx, "stable", "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = d.Transaction(ctx, func(ctx context.Context) error {
+		err := d.InsertPackageInfo(ctx, "stable", "main", "amd64", PackageInfo{Name: "foo", Version: "2.0", Depends: depends})
+		if err != nil {
+			return err
+		}
+		err = d.RemovePackageInfo(ctx, "stable", "main", "amd64", "foo", "1.0")
+		if err != nil {
+			return err
+		}
+		err = d.InsertPackagePopularity(ctx, "stable", "foo", 2)
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("transaction should fail with the error of its function, but error is %v", err)
+	}
+
+	if pi, err := d.GetPackageInfo(ctx, "stable", "amd64", "foo"); err != nil || pi.Version != "1.0" {
+		t.Errorf("rolled back transaction should keep foo 1.0, but has %q (%v)", pi.Version, err)
+	}
+	if rdeps, err := d.GetReverseRelations(ctx, "stable", "amd64", "libc6"); err != nil || len(rdeps) != 1 || rdeps[0].Version != "1.0" {
+		t.Errorf("rolled back transaction should keep the reverse dependency of foo 1.0, but has %+v (%v)", rdeps, err)
+	}
+	if pop, err := d.GetPackagePopularity(ctx, "stable", "foo"); err != nil || pop != 1 {
+		t.Errorf("rolled back transaction should keep popularity 1, but has %d (%v)", pop, err)
+	}
+}
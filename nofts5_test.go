@@ -0,0 +1,78 @@
+//go:build !sqlite_fts5 && !sqlite_purego
+
+package godebian
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// hasFTS5 is whether the SQLite driver of this build includes FTS5.
+const hasFTS5 = false
+
+func TestOpenPathIndexWithoutFTS5(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	d := SqliteDb{dbPath: path}
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/bin/foo", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.Close()
+
+	// a build with FTS5 indexed the paths; modernc.org/sqlite includes it
+	fts, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE VIRTUAL TABLE file_fts USING fts5(path, content = '', contentless_delete = 1, tokenize = 'trigram')`,
+		`INSERT INTO file_fts (rowid, path) SELECT id, path FROM file2package`,
+	} {
+		_, err = fts.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fts.Close()
+
+	d = SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatalf("db with a path index should be opened without FTS5, but failed: %v", err)
+	}
+	defer d.db.Close()
+	if d.pathIndex {
+		t.Fatal("path index should not be used without FTS5")
+	}
+
+	err = d.InsertPackageFile(ctx, "stable", "amd64", "main", "/usr/bin/bar", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newPathMatcher("bin/", SearchOptions{Mode: SearchSubstring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := d.GetPackagesMatching(ctx, "stable", m)
+	sort.Strings(pkgs)
+	if err != nil || strings.Join(pkgs, " ") != "bar foo" {
+		t.Errorf("substring search should find bar and foo without the path index, but finds %v (%v)", pkgs, err)
+	}
+
+	var stale int
+	err = d.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'path_index_stale'`).Scan(&stale)
+	if err != nil || stale != 1 {
+		t.Errorf("path index should be marked as stale (%v)", err)
+	}
+}
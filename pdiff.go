@@ -0,0 +1,751 @@
+package godebian
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pdiffEntry is a line of one of the hash tables in a PDiff Index file.
+type pdiffEntry struct {
+	sha256 string
+	size   int64
+	name   string
+}
+
+// pdiffIndex is the parsed content of an <index>.diff/Index file.
+type pdiffIndex struct {
+	current   pdiffEntry
+	history   []pdiffEntry
+	patches   map[string]pdiffEntry
+	downloads map[string]pdiffEntry
+	// merged is set if every patch turns its history entry directly into
+	// the current file instead of into the next history entry.
+	merged bool
+}
+
+func parsePDiffIndex(r io.Reader) (*pdiffIndex, error) {
+	idx := &pdiffIndex{
+		patches:   make(map[string]pdiffEntry),
+		downloads: make(map[string]pdiffEntry),
+	}
+
+	var field string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			ss := strings.Fields(line)
+			if len(ss) != 3 {
+				return nil, fmt.Errorf("invalid line in PDiff Index: %q", line)
+			}
+			size, err := strconv.ParseInt(ss[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in PDiff Index line %q: %v", line, err)
+			}
+			entry := pdiffEntry{sha256: ss[0], size: size, name: ss[2]}
+
+			switch field {
+			case "SHA256-History":
+				idx.history = append(idx.history, entry)
+			case "SHA256-Patches":
+				idx.patches[entry.name] = entry
+			case "SHA256-Download":
+				idx.downloads[entry.name] = entry
+			}
+			continue
+		}
+
+		ss := strings.SplitN(line, ":", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("invalid line in PDiff Index: %q", line)
+		}
+		field = ss[0]
+		value := strings.Fields(ss[1])
+
+		switch field {
+		case "SHA256-Current":
+			if len(value) != 2 {
+				return nil, fmt.Errorf("invalid SHA256-Current in PDiff Index: %q", line)
+			}
+			size, err := strconv.ParseInt(value[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in PDiff Index line %q: %v", line, err)
+			}
+			idx.current = pdiffEntry{sha256: value[0], size: size}
+		case "X-Patch-Precedence":
+			idx.merged = len(value) == 1 && value[0] == "merged"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if idx.current.sha256 == "" {
+		return nil, fmt.Errorf("PDiff Index has no SHA256-Current")
+	}
+
+	return idx, nil
+}
+
+// patchesFrom returns the names of the patches that turn the file with the
+// given SHA256 into the current one, in the order they have to be applied.
+func (idx *pdiffIndex) patchesFrom(sha string) ([]string, bool) {
+	for i, entry := range idx.history {
+		if entry.sha256 != sha {
+			continue
+		}
+
+		if idx.merged {
+			return []string{entry.name}, true
+		}
+
+		var names []string
+		for _, e := range idx.history[i:] {
+			names = append(names, e.name)
+		}
+		return names, true
+	}
+
+	return nil, false
+}
+
+// edCommand is a single command of an ed script as written by diff --ed.
+type edCommand struct {
+	op    byte
+	start int
+	end   int
+	lines []string
+}
+
+var edCommandRegexp = regexp.MustCompile(`^([0-9]+)(?:,([0-9]+))?([acd])$`)
+
+// parseEdScript parses an ed script and returns its commands ordered by
+// line number.
+func parseEdScript(r io.Reader) ([]edCommand, error) {
+	var cmds []edCommand
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := edCommandRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported ed command %q", line)
+		}
+
+		cmd := edCommand{op: m[3][0]}
+		cmd.start, _ = strconv.Atoi(m[1])
+		cmd.end = cmd.start
+		if m[2] != "" {
+			cmd.end, _ = strconv.Atoi(m[2])
+		}
+
+		if cmd.op != 'd' {
+			terminated := false
+			for scanner.Scan() {
+				if scanner.Text() == "." {
+					terminated = true
+					break
+				}
+				cmd.lines = append(cmd.lines, scanner.Text())
+			}
+			if !terminated {
+				return nil, fmt.Errorf("unterminated ed command %q", line)
+			}
+		}
+
+		cmds = append(cmds, cmd)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(cmds, func(i, j int) bool { return cmds[i].start < cmds[j].start })
+
+	return cmds, nil
+}
+
+// applyEdScript writes old with cmds applied to w. Every line of old is
+// passed to oldLine and every line written to w is passed to newLine,
+// together with whether the script removed or added it.
+func applyEdScript(old io.Reader, w io.Writer, cmds []edCommand, oldLine, newLine func(line string, changed bool)) error {
+	bw := bufio.NewWriter(w)
+	emit := func(line string, added bool) {
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+		newLine(line, added)
+	}
+
+	ci := 0
+	appendLines := func(lineNo int) {
+		for ci < len(cmds) && cmds[ci].op == 'a' && cmds[ci].start == lineNo {
+			for _, l := range cmds[ci].lines {
+				emit(l, true)
+			}
+			ci++
+		}
+	}
+
+	appendLines(0)
+
+	lineNo := 0
+	scanner := bufio.NewScanner(old)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+
+		if ci < len(cmds) && cmds[ci].op != 'a' && lineNo >= cmds[ci].start && lineNo <= cmds[ci].end {
+			oldLine(line, true)
+			if lineNo == cmds[ci].end {
+				for _, l := range cmds[ci].lines {
+					emit(l, true)
+				}
+				ci++
+			}
+			continue
+		}
+
+		oldLine(line, false)
+		emit(line, false)
+		appendLines(lineNo)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if ci < len(cmds) {
+		return fmt.Errorf("ed command at line %d is beyond the end of the file (%d lines)", cmds[ci].start, lineNo)
+	}
+
+	return bw.Flush()
+}
+
+// stanzaTracker groups the lines of a Packages file into stanzas and reports
+// those stanzas that contain a changed line.
+type stanzaTracker struct {
+	lines     []string
+	dirty     bool
+	onChanged func(lines []string)
+}
+
+func (s *stanzaTracker) line(line string, changed bool) {
+	if line != "" {
+		s.lines = append(s.lines, line)
+		s.dirty = s.dirty || changed
+		return
+	}
+
+	// an added or removed separator merges or splits the stanzas around it
+	s.dirty = s.dirty || changed
+	s.flush()
+	s.dirty = changed
+}
+
+func (s *stanzaTracker) flush() {
+	if len(s.lines) > 0 && s.dirty {
+		s.onChanged(s.lines)
+	}
+	s.lines = nil
+	s.dirty = false
+}
+
+// indexPatcher turns the lines changed by a PDiff into database updates.
+type indexPatcher interface {
+	oldLine(line string, removed bool)
+	newLine(line string, added bool)
+	// endPatch is called after each patch has been applied.
+	endPatch()
+	// apply writes all collected changes to the database.
+	apply(ctx context.Context) error
+}
+
+type contentsPatcher struct {
+	d       *DebianContents
+	arch    string
+	repo    string
+	removed []string
+	added   []string
+	updates []func(ctx context.Context) error
+}
+
+func (p *contentsPatcher) oldLine(line string, removed bool) {
+	if removed {
+		p.removed = append(p.removed, line)
+	}
+}
+
+func (p *contentsPatcher) newLine(line string, added bool) {
+	if added {
+		p.added = append(p.added, line)
+	}
+}
+
+func (p *contentsPatcher) endPatch() {
+	removed, added := p.removed, p.added
+	p.removed, p.added = nil, nil
+
+	p.updates = append(p.updates, func(ctx context.Context) error {
+		for _, line := range removed {
+			path, pkgs, ok := parseContentsLine(line)
+			if !ok {
+				continue
+			}
+			for _, pkg := range pkgs {
+				err := p.d.db.RemovePackageFile(ctx, p.d.distroWithVersion, p.arch, p.repo, path, pkg)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, line := range added {
+			path, pkgs, ok := parseContentsLine(line)
+			if !ok {
+				continue
+			}
+			for _, pkg := range pkgs {
+				err := p.d.db.InsertPackageFile(ctx, p.d.distroWithVersion, p.arch, p.repo, path, pkg)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (p *contentsPatcher) apply(ctx context.Context) error {
+	return applyUpdates(ctx, p.d.db, p.updates)
+}
+
+type packagesPatcher struct {
+	d          *DebianContents
+	arch       string
+	repo       string
+	oldStanzas stanzaTracker
+	newStanzas stanzaTracker
+	removed    []PackageInfo
+	added      []PackageInfo
+	updates    []func(ctx context.Context) error
+	// err is the first error parsing a changed stanza.
+	err error
+}
+
+func newPackagesPatcher(d *DebianContents, arch, repo string) *packagesPatcher {
+	p := &packagesPatcher{d: d, arch: arch, repo: repo}
+	p.oldStanzas.onChanged = func(lines []string) {
+		pi, err := packageInfoFromStanza(lines)
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.removed = append(p.removed, pi)
+	}
+	p.newStanzas.onChanged = func(lines []string) {
+		pi, err := packageInfoFromStanza(lines)
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.added = append(p.added, pi)
+	}
+
+	return p
+}
+
+func (p *packagesPatcher) oldLine(line string, removed bool) {
+	p.oldStanzas.line(line, removed)
+}
+
+func (p *packagesPatcher) newLine(line string, added bool) {
+	p.newStanzas.line(line, added)
+}
+
+func (p *packagesPatcher) endPatch() {
+	p.oldStanzas.flush()
+	p.newStanzas.flush()
+	removed, added := p.removed, p.added
+	p.removed, p.added = nil, nil
+
+	p.updates = append(p.updates, func(ctx context.Context) error {
+		for _, pi := range removed {
+			err := p.d.db.RemovePackageInfo(ctx, p.d.distroWithVersion, p.repo, p.arch, pi.Name, pi.Version)
+			if err != nil {
+				return err
+			}
+		}
+		for _, pi := range added {
+			err := p.d.db.InsertPackageInfo(ctx, p.d.distroWithVersion, p.repo, p.arch, pi)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (p *packagesPatcher) apply(ctx context.Context) error {
+	if p.err != nil {
+		return fmt.Errorf("%w: %w", errNoPDiffs, p.err)
+	}
+
+	return applyUpdates(ctx, p.d.db, p.updates)
+}
+
+func applyUpdates(ctx context.Context, db Db, updates []func(ctx context.Context) error) error {
+	return db.Transaction(ctx, func(ctx context.Context) error {
+		for _, update := range updates {
+			err := update(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// cacheFile is the local, gzip compressed copy of an uncompressed index file
+// that PDiffs are applied to.
+type cacheFile struct {
+	path   string
+	tmp    *os.File
+	gzw    *gzip.Writer
+	hash   hash.Hash
+	closed bool
+}
+
+// cacheFiles are the local copies of index files written during an update;
+// they replace the previous ones once the update is committed.
+type cacheFiles []*cacheFile
+
+func (cs *cacheFiles) add(c *cacheFile) {
+	if c != nil {
+		*cs = append(*cs, c)
+	}
+}
+
+func (cs cacheFiles) commit() {
+	for _, c := range cs {
+		c.commit()
+	}
+}
+
+func (cs cacheFiles) abort() {
+	for _, c := range cs {
+		c.abort()
+	}
+}
+
+func (d *DebianContents) cachePath(path string) string {
+	if d.cacheDir == "" {
+		return ""
+	}
+
+	base, _ := splitCompression(path)
+
+	return filepath.Join(d.cacheDir, filepath.FromSlash(d.distroWithVersion), filepath.FromSlash(base)+".gz")
+}
+
+// setIndexSHA256 records the SHA256 of the uncompressed content of the index
+// file path that the database contains now.
+func (d *DebianContents) setIndexSHA256(ctx context.Context, path, sum string) error {
+	base, _ := splitCompression(path)
+
+	return d.db.SetIndexSHA256(ctx, d.distroWithVersion, base, sum)
+}
+
+// newCacheFile starts writing the local copy of the index file path; it
+// returns nil if there is no cache directory.
+func (d *DebianContents) newCacheFile(path string) (*cacheFile, error) {
+	cachePath := d.cachePath(path)
+	if cachePath == "" {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheFile{path: cachePath, tmp: tmp, gzw: gzip.NewWriter(tmp), hash: sha256.New()}, nil
+}
+
+func (c *cacheFile) Write(p []byte) (int, error) {
+	if c == nil {
+		return len(p), nil
+	}
+
+	c.hash.Write(p)
+
+	return c.gzw.Write(p)
+}
+
+func (c *cacheFile) sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// close finishes writing the new local copy.
+func (c *cacheFile) close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	err := c.gzw.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.tmp.Close()
+}
+
+// commit replaces the previous local copy and records the SHA256 of its
+// uncompressed content. The database already contains the new content, so
+// if that fails, the local copy is invalidated instead: without its SHA256
+// the next update downloads the full index file rather than patching it.
+func (c *cacheFile) commit() {
+	if c == nil {
+		return
+	}
+
+	os.Remove(c.path + ".sha256")
+
+	err := c.close()
+	if err == nil {
+		err = os.Rename(c.tmp.Name(), c.path)
+	}
+	if err == nil {
+		err = os.WriteFile(c.path+".sha256", []byte(c.sum()), 0644)
+	}
+	if err != nil {
+		os.Remove(c.path + ".sha256")
+		c.abort()
+	}
+}
+
+// abort removes the new local copy unless it has been committed.
+func (c *cacheFile) abort() {
+	if c == nil {
+		return
+	}
+
+	c.tmp.Close()
+	os.Remove(c.tmp.Name())
+}
+
+// errNoPDiffs is returned by tryApplyPDiffs if the index file can't be
+// patched, e.g. because there is no local copy or the mirror has no patches
+// for it.
+var errNoPDiffs = errors.New("no usable PDiffs")
+
+// applyPDiffs tries to bring the database up to date with the index file
+// path by applying the patches listed in <path>.diff/Index to the local copy
+// of the file; the patched copy is added to caches. It returns false without
+// error if the caller has to fall back to a full download; errors of ctx and
+// the database are returned.
+func (d *DebianContents) applyPDiffs(ctx context.Context, path string, patcher indexPatcher, caches *cacheFiles) (bool, error) {
+	err := d.tryApplyPDiffs(ctx, path, patcher, caches)
+	if errors.Is(err, errNoPDiffs) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// noPDiffs returns err, which keeps the patches from being applied, as
+// errNoPDiffs unless ctx is done.
+func noPDiffs(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return fmt.Errorf("%w: %w", errNoPDiffs, err)
+}
+
+func (d *DebianContents) tryApplyPDiffs(ctx context.Context, path string, patcher indexPatcher, caches *cacheFiles) error {
+	cachePath := d.cachePath(path)
+	if cachePath == "" {
+		return fmt.Errorf("%w: no cache directory", errNoPDiffs)
+	}
+
+	base, _ := splitCompression(path)
+	importedSum, err := d.db.GetIndexSHA256(ctx, d.distroWithVersion, base)
+	if err != nil {
+		return err
+	}
+	if importedSum == "" {
+		return fmt.Errorf("%w: SHA256 of the imported %s is unknown", errNoPDiffs, base)
+	}
+
+	localSum, err := os.ReadFile(cachePath + ".sha256")
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: no local copy of %s", errNoPDiffs, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	diffDir := base + ".diff"
+
+	idx, err := d.fetchPDiffIndex(ctx, diffDir+"/Index")
+	if err != nil {
+		return noPDiffs(ctx, err)
+	}
+
+	if idx.current.sha256 == importedSum {
+		return nil
+	}
+
+	// the cache directory may be shared with databases that imported
+	// another version of the index file
+	if string(localSum) != importedSum {
+		return fmt.Errorf("%w: local copy of %s is not the imported one", errNoPDiffs, base)
+	}
+
+	names, ok := idx.patchesFrom(importedSum)
+	if !ok {
+		return fmt.Errorf("%w: local copy of %s is not in the PDiff history", errNoPDiffs, base)
+	}
+
+	// outs are the copies with the patches applied so far
+	var outs cacheFiles
+	defer func() { outs.abort() }()
+
+	current := cachePath
+	var out *cacheFile
+	for _, name := range names {
+		cmds, err := d.fetchPatch(ctx, diffDir, name, idx)
+		if err != nil {
+			return noPDiffs(ctx, err)
+		}
+
+		out, err = d.newCacheFile(path)
+		if err != nil {
+			return err
+		}
+		outs.add(out)
+
+		// a damaged local copy or a patch that doesn't fit it
+		err = applyEdScriptToFile(current, out, cmds, patcher)
+		if err != nil {
+			return noPDiffs(ctx, err)
+		}
+		patcher.endPatch()
+
+		err = out.close()
+		if err != nil {
+			return err
+		}
+		current = out.tmp.Name()
+	}
+
+	if out.sum() != idx.current.sha256 {
+		return fmt.Errorf("%w: %w: patched %s has SHA256 %s instead of %s", errNoPDiffs, ErrChecksumMismatch, base, out.sum(), idx.current.sha256)
+	}
+
+	err = patcher.apply(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = d.setIndexSHA256(ctx, path, idx.current.sha256)
+	if err != nil {
+		return err
+	}
+
+	outs = outs[:len(outs)-1]
+	caches.add(out)
+
+	return nil
+}
+
+func applyEdScriptToFile(path string, out *cacheFile, cmds []edCommand, patcher indexPatcher) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	zr, err := gzip.NewReader(fp)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return applyEdScript(zr, out, cmds, patcher.oldLine, patcher.newLine)
+}
+
+func (d *DebianContents) fetchPDiffIndex(ctx context.Context, path string) (*pdiffIndex, error) {
+	if _, ok := d.release.SHA256[path]; !ok {
+		return nil, fmt.Errorf("%s is not listed in the Release file", path)
+	}
+
+	data, err := httpGet(ctx, d.distsURL+"/"+path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := d.release.verifyIndexFile(bytes.NewReader(data), path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parsePDiffIndex(f)
+}
+
+// fetchPatch downloads the patch name and verifies it against the PDiff
+// Index.
+func (d *DebianContents) fetchPatch(ctx context.Context, diffDir, name string, idx *pdiffIndex) ([]edCommand, error) {
+	download, ok := idx.downloads[name+".gz"]
+	if !ok {
+		return nil, fmt.Errorf("patch %s is not listed in the PDiff Index", name)
+	}
+
+	data, err := httpGet(ctx, d.distsURL+"/"+diffDir+"/"+download.name)
+	if err != nil {
+		return nil, err
+	}
+
+	patchRelease := &Release{SHA256: map[string]ReleaseFile{
+		download.name: {Path: download.name, Size: download.size, SHA256: download.sha256},
+	}}
+	f, err := patchRelease.verifyIndexFile(bytes.NewReader(data), download.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := decompress(f, download.name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return parseEdScript(zr)
+}
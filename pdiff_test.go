@@ -0,0 +1,283 @@
+package godebian
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestApplyEdScript(t *testing.T) {
+	old := "a\nb\nc\nd\ne\n"
+	script := "5a\nf\n.\n3,4c\nC\n.\n1d\n0a\nstart\n.\n"
+
+	cmds, err := parseEdScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("parsing ed script failed: %v", err)
+	}
+
+	var removed, added []string
+	var out bytes.Buffer
+	err = applyEdScript(strings.NewReader(old), &out, cmds,
+		func(line string, changed bool) {
+			if changed {
+				removed = append(removed, line)
+			}
+		},
+		func(line string, changed bool) {
+			if changed {
+				added = append(added, line)
+			}
+		})
+	if err != nil {
+		t.Fatalf("applying ed script failed: %v", err)
+	}
+
+	if out.String() != "start\nb\nC\ne\nf\n" {
+		t.Fatalf("unexpected result %q", out.String())
+	}
+	if strings.Join(removed, " ") != "a c d" || strings.Join(added, " ") != "start C f" {
+		t.Fatalf("unexpected removed lines %+v or added lines %+v", removed, added)
+	}
+
+	cmds, _ = parseEdScript(strings.NewReader("10d\n"))
+	err = applyEdScript(strings.NewReader(old), &out, cmds, func(string, bool) {}, func(string, bool) {})
+	if err == nil {
+		t.Fatalf("ed command beyond the end of the file should fail")
+	}
+}
+
+func TestPDiffIndexPatchesFrom(t *testing.T) {
+	index := `SHA256-Current: cccc 30
+SHA256-History:
+ aaaa 10 T-1
+ bbbb 20 T-2
+SHA256-Patches:
+ 1111 5 T-1
+ 2222 6 T-2
+SHA256-Download:
+ 3333 7 T-1.gz
+ 4444 8 T-2.gz
+`
+	idx, err := parsePDiffIndex(strings.NewReader(index))
+	if err != nil {
+		t.Fatalf("parsing PDiff Index failed: %v", err)
+	}
+
+	names, ok := idx.patchesFrom("aaaa")
+	if !ok || strings.Join(names, " ") != "T-1 T-2" {
+		t.Fatalf("patches from aaaa should be T-1 T-2, but are %+v", names)
+	}
+
+	idx.merged = true
+	names, ok = idx.patchesFrom("aaaa")
+	if !ok || strings.Join(names, " ") != "T-1" {
+		t.Fatalf("merged patches from aaaa should be T-1, but are %+v", names)
+	}
+
+	_, ok = idx.patchesFrom("dddd")
+	if ok {
+		t.Fatalf("unknown hash should not have patches")
+	}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// setPDiff publishes a PDiff Index with a single patch that turns old into
+// current.
+func (m *testMirror) setPDiff(diffDir, old, current, patch string) {
+	m.setGzip(diffDir+"/T-1.gz", patch)
+	m.files[diffDir+"/Index"] = []byte(fmt.Sprintf(`SHA256-Current: %s %d
+SHA256-History:
+ %s %d T-1
+SHA256-Patches:
+ %s %d T-1
+SHA256-Download:
+ %s %d T-1.gz
+`, sha256Hex(current), len(current), sha256Hex(old), len(old), sha256Hex(patch), len(patch),
+		sha256Hex(string(m.files[diffDir+"/T-1.gz"])), len(m.files[diffDir+"/T-1.gz"])))
+}
+
+func TestPDiffUpdate(t *testing.T) {
+	m := newTestMirror(t)
+	db := newTestDb(t)
+
+	oldContents := "usr/bin/bar\tutils/bar\nusr/bin/foo\tutils/foo\nusr/share/doc/foo/copyright\tutils/foo\n"
+	newContents := "usr/bin/baz\tutils/baz\nusr/bin/foo\tutils/foo\n"
+	oldPackages := "Package: bar\nVersion: 1.0\nFilename: pool/main/b/bar/bar_1.0_amd64.deb\n\n" +
+		"Package: foo\nVersion: 1.0\nFilename: pool/main/f/foo/foo_1.0_amd64.deb\n"
+	newPackages := "Package: bar\nVersion: 1.0\nFilename: pool/main/b/bar/bar_1.0_amd64.deb\n\n" +
+		"Package: foo\nVersion: 1.1\nFilename: pool/main/f/foo/foo_1.1_amd64.deb\n"
+
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", oldContents)
+	m.setGzip("/debian/dists/stable/main/binary-amd64/Packages.gz", oldPackages)
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+	dc, err := NewContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs, err := dc.Search("/usr/bin/bar"); err != nil || len(pkgs) != 1 {
+		t.Fatalf("/usr/bin/bar should be found after the full import, but is %+v (%v)", pkgs, err)
+	}
+
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", newContents)
+	m.setGzip("/debian/dists/stable/main/binary-amd64/Packages.gz", newPackages)
+	m.setPDiff("/debian/dists/stable/main/Contents-amd64.diff", oldContents, newContents, "3d\n1c\nusr/bin/baz\tutils/baz\n.\n")
+	m.setPDiff("/debian/dists/stable/main/binary-amd64/Packages.diff", oldPackages, newPackages,
+		"6,7c\nVersion: 1.1\nFilename: pool/main/f/foo/foo_1.1_amd64.deb\n.\n")
+	m.requests = nil
+
+	dc, err = NewContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.requested("/debian/dists/stable/main/Contents-amd64.gz") || m.requested("/debian/dists/stable/main/binary-amd64/Packages.gz") {
+		t.Fatalf("index files should be patched instead of downloaded: %+v", m.requests)
+	}
+
+	for path, expected := range map[string]int{"/usr/bin/bar": 0, "/usr/bin/baz": 1, "/usr/bin/foo": 1, "/usr/share/doc/foo/copyright": 0} {
+		if pkgs, err := dc.Search(path); err != nil || len(pkgs) != expected {
+			t.Errorf("%s should be in %d packages after patching, but is in %+v (%v)", path, expected, pkgs, err)
+		}
+	}
+
+	if pi, err := dc.PackageInfo("foo"); err != nil || pi.Filename != "pool/main/f/foo/foo_1.1_amd64.deb" {
+		t.Errorf("foo should have been patched to 1.1, but is %+v (%v)", pi, err)
+	}
+}
+
+func TestPDiffUpdateSharedCacheDir(t *testing.T) {
+	m := newTestMirror(t)
+	db1 := newTestDb(t)
+	db2 := newTestDb(t)
+
+	oldContents := "usr/bin/bar\tutils/bar\nusr/bin/foo\tutils/foo\n"
+	newContents := "usr/bin/baz\tutils/baz\nusr/bin/foo\tutils/foo\n"
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", oldContents)
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+	_, err := NewContents(opts, db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// db2 replaces the local copy of db1's index with the new one
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", newContents)
+	m.setPDiff("/debian/dists/stable/main/Contents-amd64.diff", oldContents, newContents, "1c\nusr/bin/baz\tutils/baz\n.\n")
+	_, err = NewContents(opts, db2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.requests = nil
+
+	dc, err := NewContents(opts, db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.requested("/debian/dists/stable/main/Contents-amd64.gz") {
+		t.Errorf("index file should be downloaded if the local copy is not the imported one: %+v", m.requests)
+	}
+	for path, expected := range map[string]int{"/usr/bin/bar": 0, "/usr/bin/baz": 1, "/usr/bin/foo": 1} {
+		if pkgs, err := dc.Search(path); err != nil || len(pkgs) != expected {
+			t.Errorf("%s should be in %d packages after the update, but is in %+v (%v)", path, expected, pkgs, err)
+		}
+	}
+}
+
+// failingMemoryDb is a MemoryDb whose file removals fail with err once it is
+// set.
+type failingMemoryDb struct {
+	*MemoryDb
+	err error
+}
+
+func (d *failingMemoryDb) RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	return d.MemoryDb.RemovePackageFile(ctx, version, arch, repo, path, filePackage)
+}
+
+func TestPDiffUpdateErrors(t *testing.T) {
+	m := newTestMirror(t)
+	db := &failingMemoryDb{MemoryDb: NewMemoryDb()}
+
+	oldContents := "usr/bin/bar\tutils/bar\nusr/bin/foo\tutils/foo\n"
+	newContents := "usr/bin/foo\tutils/foo\n"
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", oldContents)
+
+	opts := ContentsOptions{
+		Distro:        "debian",
+		MirrorURL:     m.srv.URL + "/debian/",
+		Suite:         "stable",
+		Architectures: []string{"amd64"},
+		CacheDir:      t.TempDir(),
+	}
+	dc, err := NewContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.setGzip("/debian/dists/stable/main/Contents-amd64.gz", newContents)
+	m.setPDiff("/debian/dists/stable/main/Contents-amd64.diff", oldContents, newContents, "1d\n")
+	m.requests = nil
+
+	// a failing database write is returned instead of falling back to a
+	// full download
+	db.err = errors.New("failed")
+	err = dc.Update(context.Background())
+	if !errors.Is(err, db.err) {
+		t.Fatalf("update should fail with the database error, but error is %v", err)
+	}
+	if m.requested("/debian/dists/stable/main/Contents-amd64.gz") {
+		t.Fatalf("failed patch should not fall back to a full download")
+	}
+
+	// the failed update kept the Release file without the patches
+	db.err = nil
+	dc.release, _, err = fetchRelease(context.Background(), dc.distsURL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var caches cacheFiles
+	defer caches.abort()
+	patched, err := dc.applyPDiffs(ctx, "main/Contents-amd64.gz", &contentsPatcher{d: &dc, arch: "amd64", repo: "main"}, &caches)
+	if patched || !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled patching should fail with context.Canceled, but is %v (%v)", patched, err)
+	}
+
+	patched, err = dc.applyPDiffs(context.Background(), "main/Contents-amd64.gz", &contentsPatcher{d: &dc, arch: "amd64", repo: "main"}, &caches)
+	if !patched || err != nil {
+		t.Fatalf("index file should be patched, but is %v (%v)", patched, err)
+	}
+	if pkgs, err := dc.Search("/usr/bin/bar"); err != nil || len(pkgs) != 0 {
+		t.Errorf("/usr/bin/bar should be removed by the patch, but is in %+v (%v)", pkgs, err)
+	}
+}
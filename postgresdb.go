@@ -0,0 +1,693 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresMigration changes the schema of a PostgresDb from the version of
+// the previous migration to its own version, its position in
+// postgresMigrations plus one.
+type postgresMigration struct {
+	description string
+	stmts       []string
+}
+
+// postgresMigrations are applied in order; new migrations are appended.
+var postgresMigrations = []postgresMigration{
+	{description: "create tables", stmts: []string{
+		`CREATE TABLE etag (kind TEXT, version TEXT, arch TEXT, repo TEXT, current TEXT NOT NULL,
+			PRIMARY KEY(kind, version, arch, repo))`,
+		`CREATE TABLE suite (id SERIAL PRIMARY KEY, version TEXT NOT NULL, arch TEXT NOT NULL, repo TEXT NOT NULL,
+			UNIQUE(version, arch, repo))`,
+		// name is the base name of path, for looking up relative paths
+		`CREATE TABLE file (suite_id INTEGER NOT NULL REFERENCES suite(id), path TEXT NOT NULL,
+			name TEXT GENERATED ALWAYS AS (substring(path from '[^/]*$')) STORED, package TEXT NOT NULL,
+			PRIMARY KEY(suite_id, path, package))`,
+		`CREATE INDEX file_path_idx ON file(path)`,
+		`CREATE INDEX file_name_idx ON file(name)`,
+		`CREATE INDEX file_package_idx ON file(package)`,
+		`CREATE TABLE popularity (version TEXT, package TEXT, popularity INTEGER NOT NULL, PRIMARY KEY(version, package))`,
+		`CREATE TABLE packageinfo (version TEXT, repo TEXT NOT NULL, arch TEXT, package TEXT, package_version TEXT,
+			filename TEXT NOT NULL, control TEXT NOT NULL,
+			PRIMARY KEY(version, arch, package, package_version))`,
+		`CREATE TABLE relation (version TEXT, repo TEXT NOT NULL, arch TEXT, package TEXT, package_version TEXT,
+			field TEXT, alternative INTEGER, position INTEGER, name TEXT NOT NULL, arch_qualifier TEXT NOT NULL,
+			op TEXT NOT NULL, rel_version TEXT NOT NULL, arches TEXT NOT NULL, profiles TEXT NOT NULL,
+			PRIMARY KEY(version, arch, package, package_version, field, alternative, position))`,
+		`CREATE INDEX relation_name_idx ON relation(version, arch, name)`,
+		`CREATE TABLE release (version TEXT PRIMARY KEY, updated BIGINT NOT NULL, content BYTEA NOT NULL)`,
+	}},
+	{description: "create index checksum table", stmts: []string{
+		`CREATE TABLE index_sha256 (version TEXT, path TEXT, sha256 TEXT NOT NULL, PRIMARY KEY(version, path))`,
+	}},
+	{description: "add release signature column", stmts: []string{
+		`ALTER TABLE release ADD COLUMN signature BYTEA`,
+	}},
+}
+
+// pgQuerier is implemented by the pool and by transactions.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// PostgresDb is a Db stored in a PostgreSQL database, which one updater can
+// share with many readers. Its tables are created in the first schema of
+// the search path.
+type PostgresDb struct {
+	pool *pgxpool.Pool
+}
+
+// pgTxKey is the context key of the transaction of a PostgresDb.
+type pgTxKey struct{}
+
+// pgTx is the transaction of the contexts passed to the function of
+// PostgresDb.Transaction.
+type pgTx struct {
+	db *PostgresDb
+	// mu serializes the use of tx
+	mu sync.Mutex
+	tx pgx.Tx
+}
+
+// txOf returns the transaction of db that ctx belongs to, or nil.
+func (db *PostgresDb) txOf(ctx context.Context) *pgTx {
+	t, ok := ctx.Value(pgTxKey{}).(*pgTx)
+	if !ok || t.db != db {
+		return nil
+	}
+
+	return t
+}
+
+// OpenPostgresDb connects to the database described by dsn, e.g.
+// "postgres://user@host/godebian", and creates or migrates its tables and
+// the path index, which needs the pg_trgm extension.
+func OpenPostgresDb(ctx context.Context, dsn string) (*PostgresDb, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open db: %w", err)
+	}
+
+	db := &PostgresDb{pool: pool}
+	err = db.migrate(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	err = db.createPathIndex(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Close closes the connections to the database.
+func (db *PostgresDb) Close() {
+	db.pool.Close()
+}
+
+// migrate applies the migrations the database hasn't seen yet in a single
+// transaction, like SqliteDb.migrate.
+func (db *PostgresDb) migrate(ctx context.Context) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not migrate db: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// processes opening a new database at the same time wait for the first
+	// one to create it
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('godebian schema'))")
+	if err != nil {
+		return fmt.Errorf("could not lock schema: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("could not create schema version table: %w", err)
+	}
+
+	var version int
+	err = tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %w", err)
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("%w: database has schema version %d, but only %d is supported", ErrSchemaTooNew, version, len(postgresMigrations))
+	}
+	if version == len(postgresMigrations) {
+		return nil
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		for _, stmt := range postgresMigrations[i].stmts {
+			_, err = tx.Exec(ctx, stmt)
+			if err != nil {
+				return fmt.Errorf("migrating db to schema version %d (%s) failed: %w", i+1, postgresMigrations[i].description, err)
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM schema_version")
+	if err == nil {
+		_, err = tx.Exec(ctx, "INSERT INTO schema_version (version) VALUES ($1)", len(postgresMigrations))
+	}
+	if err != nil {
+		return fmt.Errorf("could not set schema version: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// createPathIndex creates a trigram index of the paths of the files, which
+// lets the ILIKE queries of substring, glob and regexp searches skip the scan
+// of all files. It needs the pg_trgm extension in the search path; users
+// that may not create it need it to be created for them.
+func (db *PostgresDb) createPathIndex(ctx context.Context) error {
+	_, err := db.pool.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	if err != nil {
+		return fmt.Errorf("could not create the pg_trgm extension for the path index: %w", err)
+	}
+
+	_, err = db.pool.Exec(ctx, "CREATE INDEX IF NOT EXISTS file_path_trgm_idx ON file USING gin (path gin_trgm_ops)")
+	if err != nil {
+		return fmt.Errorf("could not create path index: %w", err)
+	}
+
+	return nil
+}
+
+// run calls f with the transaction of ctx or, without one, with the pool.
+func (db *PostgresDb) run(ctx context.Context, f func(q pgQuerier) error) error {
+	t := db.txOf(ctx)
+	if t == nil {
+		return f(db.pool)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return f(t.tx)
+}
+
+func (db *PostgresDb) exec(ctx context.Context, sql string, args ...any) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		_, err := q.Exec(ctx, sql, args...)
+		return err
+	})
+}
+
+// queryStrings returns the single string column of the rows of the query.
+func (db *PostgresDb) queryStrings(ctx context.Context, sql string, args ...any) ([]string, error) {
+	var ss []string
+	err := db.run(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		ss, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		return err
+	})
+
+	return ss, err
+}
+
+func (db *PostgresDb) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if db.txOf(ctx) != nil {
+		return f(ctx)
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = f(context.WithValue(ctx, pgTxKey{}, &pgTx{db: db, tx: tx}))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// LockSuite takes an advisory lock of version on a connection of its own;
+// imports of different suites run in parallel.
+func (db *PostgresDb) LockSuite(ctx context.Context, version string) (func(), error) {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext('godebian suite ' || $1))", version)
+	if err != nil {
+		// closing the connection drops a lock granted despite the error
+		conn.Conn().Close(context.Background())
+		conn.Release()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("could not lock suite %s: %w", version, err)
+	}
+
+	return func() {
+		conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext('godebian suite ' || $1))", version)
+		conn.Release()
+	}, nil
+}
+
+func (db *PostgresDb) setETag(ctx context.Context, etag, kind, version, arch, repo string) error {
+	return db.exec(ctx, `INSERT INTO etag (kind, version, arch, repo, current) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (kind, version, arch, repo) DO UPDATE SET current = EXCLUDED.current`,
+		kind, version, arch, repo, etag)
+}
+
+func (db *PostgresDb) getETag(ctx context.Context, kind, version, arch, repo string) (string, error) {
+	etags, err := db.queryStrings(ctx, "SELECT current FROM etag WHERE kind = $1 AND version = $2 AND arch = $3 AND repo = $4",
+		kind, version, arch, repo)
+	if err != nil || len(etags) == 0 {
+		return "", err
+	}
+
+	return etags[0], nil
+}
+
+func (db *PostgresDb) SetIndexSHA256(ctx context.Context, version, path, sum string) error {
+	return db.exec(ctx, `INSERT INTO index_sha256 (version, path, sha256) VALUES ($1, $2, $3)
+			ON CONFLICT (version, path) DO UPDATE SET sha256 = EXCLUDED.sha256`,
+		version, path, sum)
+}
+
+func (db *PostgresDb) GetIndexSHA256(ctx context.Context, version, path string) (string, error) {
+	sums, err := db.queryStrings(ctx, "SELECT sha256 FROM index_sha256 WHERE version = $1 AND path = $2", version, path)
+	if err != nil || len(sums) == 0 {
+		return "", err
+	}
+
+	return sums[0], nil
+}
+
+func (db *PostgresDb) SetContentETag(ctx context.Context, version, arch, repo, etag string) error {
+	return db.setETag(ctx, etag, "contents", version, arch, repo)
+}
+
+func (db *PostgresDb) GetContentETag(ctx context.Context, version, arch, repo string) (string, error) {
+	return db.getETag(ctx, "contents", version, arch, repo)
+}
+
+func (db *PostgresDb) SetPopularityETag(ctx context.Context, version, etag string) error {
+	return db.setETag(ctx, etag, "popularity", version, "", "")
+}
+
+func (db *PostgresDb) GetPopularityETag(ctx context.Context, version string) (string, error) {
+	return db.getETag(ctx, "popularity", version, "", "")
+}
+
+func (db *PostgresDb) SetPackageInfoETag(ctx context.Context, version, repo, arch, etag string) error {
+	return db.setETag(ctx, etag, "packageinfo", version, arch, repo)
+}
+
+func (db *PostgresDb) GetPackageInfoETag(ctx context.Context, version, repo, arch string) (string, error) {
+	return db.getETag(ctx, "packageinfo", version, arch, repo)
+}
+
+// suiteID returns the id of the suite of version, arch and repo and creates
+// it if necessary.
+func suiteID(ctx context.Context, q pgQuerier, version, arch, repo string) (int, error) {
+	var id int
+	// the update is a no-op that makes RETURNING return existing rows
+	err := q.QueryRow(ctx, `INSERT INTO suite (version, arch, repo) VALUES ($1, $2, $3)
+			ON CONFLICT (version, arch, repo) DO UPDATE SET version = EXCLUDED.version
+			RETURNING id`, version, arch, repo).Scan(&id)
+
+	return id, err
+}
+
+func (db *PostgresDb) InsertPackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		id, err := suiteID(ctx, q, version, arch, repo)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec(ctx, "INSERT INTO file (suite_id, path, package) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			id, path, filePackage)
+		return err
+	})
+}
+
+// InsertPackageFiles copies files into a temporary table and inserts them
+// from there, which is much faster than single inserts.
+func (db *PostgresDb) InsertPackageFiles(ctx context.Context, version, arch, repo string, files iter.Seq2[string, string]) error {
+	return db.Transaction(ctx, func(ctx context.Context) error {
+		t := db.txOf(ctx)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		return insertPackageFiles(ctx, t.tx, version, arch, repo, files)
+	})
+}
+
+func insertPackageFiles(ctx context.Context, tx pgx.Tx, version, arch, repo string, files iter.Seq2[string, string]) error {
+	id, err := suiteID(ctx, tx, version, arch, repo)
+	if err != nil {
+		return err
+	}
+
+	// COPY can't skip files that are already indexed
+	_, err = tx.Exec(ctx, "CREATE TEMPORARY TABLE file_import (path TEXT, package TEXT) ON COMMIT DROP")
+	if err != nil {
+		return err
+	}
+
+	next, stop := iter.Pull2(files)
+	defer stop()
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"file_import"}, []string{"path", "package"},
+		pgx.CopyFromFunc(func() ([]any, error) {
+			path, pkg, ok := next()
+			if !ok {
+				return nil, nil
+			}
+			return []any{path, pkg}, nil
+		}))
+	if err != nil {
+		return fmt.Errorf("could not copy files: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO file (suite_id, path, package) SELECT $1::integer, path, package FROM file_import
+			ON CONFLICT DO NOTHING`, id)
+	if err != nil {
+		return err
+	}
+
+	// the temporary table would only be dropped at the end of the
+	// transaction, which may import more files
+	_, err = tx.Exec(ctx, "DROP TABLE file_import")
+
+	return err
+}
+
+func (db *PostgresDb) RemovePackageFile(ctx context.Context, version, arch, repo, path, filePackage string) error {
+	return db.exec(ctx, `DELETE FROM file WHERE suite_id IN (SELECT id FROM suite WHERE version = $1 AND arch = $2 AND repo = $3)
+			AND path = $4 AND package = $5`, version, arch, repo, path, filePackage)
+}
+
+func (db *PostgresDb) RemoveAllPackages(ctx context.Context, version, arch, repo string) error {
+	return db.exec(ctx, "DELETE FROM file WHERE suite_id IN (SELECT id FROM suite WHERE version = $1 AND arch = $2 AND repo = $3)",
+		version, arch, repo)
+}
+
+// getPackagesWhere returns the packages of the files of version selected by
+// cond, whose parameters start at $2, most popular first.
+func (db *PostgresDb) getPackagesWhere(ctx context.Context, cond string, version string, args ...any) ([]string, error) {
+	return db.queryStrings(ctx, `SELECT f.package FROM file AS f JOIN suite AS s ON s.id = f.suite_id
+			LEFT JOIN popularity AS p ON p.version = s.version AND p.package = f.package
+			WHERE s.version = $1 AND `+cond+`
+			ORDER BY p.popularity ASC NULLS LAST`, append([]any{version}, args...)...)
+}
+
+func (db *PostgresDb) GetPackage(ctx context.Context, version, path string) ([]string, error) {
+	if strings.HasPrefix(path, "/") {
+		return db.getPackagesWhere(ctx, "f.path = $2", version, path)
+	}
+
+	// the directories of relative paths may have any prefix and, like with
+	// SQLite's LIKE, their case is ignored
+	_, name := splitPath("/" + path)
+	return db.getPackagesWhere(ctx, `f.name = $2 AND f.path ILIKE $3`, version, name, "%/"+escapeLike(path))
+}
+
+func (db *PostgresDb) GetPackages(ctx context.Context, version string, paths []string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	err := db.run(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, `SELECT f.path, f.package FROM file AS f JOIN suite AS s ON s.id = f.suite_id
+				LEFT JOIN popularity AS p ON p.version = s.version AND p.package = f.package
+				WHERE s.version = $1 AND f.path = ANY($2)
+				ORDER BY p.popularity ASC NULLS LAST`, version, paths)
+		if err != nil {
+			return err
+		}
+
+		var path, pkg string
+		_, err = pgx.ForEachRow(rows, []any{&path, &pkg}, func() error {
+			ret[path] = append(ret[path], pkg)
+			return nil
+		})
+		return err
+	})
+
+	return ret, err
+}
+
+func (db *PostgresDb) GetPackagesMatching(ctx context.Context, version string, m PathMatcher) ([]string, error) {
+	var pkgs []string
+	err := db.run(ctx, func(q pgQuerier) error {
+		// ILIKE ignores the case of the literal and can use the path index
+		rows, err := q.Query(ctx, `SELECT f.path, f.package FROM file AS f JOIN suite AS s ON s.id = f.suite_id
+				LEFT JOIN popularity AS p ON p.version = s.version AND p.package = f.package
+				WHERE s.version = $1 AND f.path ILIKE $2
+				ORDER BY p.popularity ASC NULLS LAST`, version, "%"+escapeLike(m.Literal)+"%")
+		if err != nil {
+			return err
+		}
+
+		var path, pkg string
+		_, err = pgx.ForEachRow(rows, []any{&path, &pkg}, func() error {
+			if m.Match(path) {
+				pkgs = append(pkgs, pkg)
+			}
+			return nil
+		})
+		return err
+	})
+
+	return pkgs, err
+}
+
+func (db *PostgresDb) GetFiles(ctx context.Context, version, pkg, arch, repo string) ([]string, error) {
+	return db.queryStrings(ctx, `SELECT DISTINCT f.path FROM file AS f JOIN suite AS s ON s.id = f.suite_id
+			WHERE s.version = $1 AND f.package = $2 AND ($3 = '' OR s.arch = $3) AND ($4 = '' OR s.repo = $4)
+			ORDER BY f.path`, version, pkg, arch, repo)
+}
+
+func (db *PostgresDb) Walk(ctx context.Context, version, arch, repo string, walker func(path, pkg string) bool) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, `SELECT f.path, f.package FROM file AS f JOIN suite AS s ON s.id = f.suite_id
+				WHERE s.version = $1 AND s.arch = $2 AND s.repo = $3`, version, arch, repo)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var path, pkg string
+			err := rows.Scan(&path, &pkg)
+			if err != nil {
+				return err
+			}
+			if !walker(path, pkg) {
+				return nil
+			}
+		}
+
+		return rows.Err()
+	})
+}
+
+func (db *PostgresDb) InsertPackageInfo(ctx context.Context, version, repo string, arch string, pi PackageInfo) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		_, err := q.Exec(ctx, `INSERT INTO packageinfo (version, repo, arch, package, package_version, filename, control)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (version, arch, package, package_version)
+				DO UPDATE SET repo = EXCLUDED.repo, filename = EXCLUDED.filename, control = EXCLUDED.control`,
+			version, repo, arch, pi.Name, pi.Version, pi.Filename, pi.Fields.String())
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec(ctx, "DELETE FROM relation WHERE version = $1 AND arch = $2 AND package = $3 AND package_version = $4",
+			version, arch, pi.Name, pi.Version)
+		if err != nil {
+			return err
+		}
+
+		var batch pgx.Batch
+		for _, field := range RelationFields {
+			for i, alternatives := range pi.Relations(field) {
+				for j, r := range alternatives {
+					batch.Queue(`INSERT INTO relation (version, repo, arch, package, package_version, field, alternative, position,
+							name, arch_qualifier, op, rel_version, arches, profiles)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+						version, repo, arch, pi.Name, pi.Version, field, i, j,
+						r.Name, r.ArchQualifier, r.Op, r.Version, strings.Join(r.Arches, " "), formatProfiles(r.Profiles))
+				}
+			}
+		}
+		if batch.Len() == 0 {
+			return nil
+		}
+
+		return q.SendBatch(ctx, &batch).Close()
+	})
+}
+
+func (db *PostgresDb) RemovePackageInfo(ctx context.Context, version, repo, arch, pkg, pkgVersion string) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		_, err := q.Exec(ctx, "DELETE FROM relation WHERE version = $1 AND repo = $2 AND arch = $3 AND package = $4 AND package_version = $5",
+			version, repo, arch, pkg, pkgVersion)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec(ctx, "DELETE FROM packageinfo WHERE version = $1 AND repo = $2 AND arch = $3 AND package = $4 AND package_version = $5",
+			version, repo, arch, pkg, pkgVersion)
+		return err
+	})
+}
+
+func (db *PostgresDb) RemoveAllPackageInfos(ctx context.Context, version, repo, arch string) error {
+	return db.run(ctx, func(q pgQuerier) error {
+		_, err := q.Exec(ctx, "DELETE FROM relation WHERE version = $1 AND repo = $2 AND arch = $3", version, repo, arch)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec(ctx, "DELETE FROM packageinfo WHERE version = $1 AND repo = $2 AND arch = $3", version, repo, arch)
+		return err
+	})
+}
+
+func (db *PostgresDb) GetPackageInfo(ctx context.Context, version, arch, pkg string) (PackageInfo, error) {
+	var pi PackageInfo
+	err := db.run(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, "SELECT package_version, filename, control FROM packageinfo WHERE version = $1 AND arch = $2 AND package = $3",
+			version, arch, pkg)
+		if err != nil {
+			return err
+		}
+
+		// the newest version wins if several versions of pkg are indexed
+		versions := storedVersions{pkg: pkg}
+		var pkgVersion, filename, control string
+		_, err = pgx.ForEachRow(rows, []any{&pkgVersion, &filename, &control}, func() error {
+			versions.add(pkgVersion, filename, control)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		pi, err = versions.newest()
+		if err != nil {
+			return err
+		}
+
+		return getPostgresRelations(ctx, q, version, arch, &pi)
+	})
+
+	return pi, err
+}
+
+// getPostgresRelations is the getRelations of SqliteDb for PostgresDb.
+func getPostgresRelations(ctx context.Context, q pgQuerier, version, arch string, pi *PackageInfo) error {
+	rows, err := q.Query(ctx, `SELECT field, alternative, name, arch_qualifier, op, rel_version, arches, profiles FROM relation
+			WHERE version = $1 AND arch = $2 AND package = $3 AND package_version = $4
+			ORDER BY field, alternative, position`, version, arch, pi.Name, pi.Version)
+	if err != nil {
+		return err
+	}
+
+	clearRelations(pi)
+	var field, arches, profiles string
+	var alternative int
+	var r Relation
+	_, err = pgx.ForEachRow(rows, []any{&field, &alternative, &r.Name, &r.ArchQualifier, &r.Op, &r.Version, &arches, &profiles}, func() error {
+		addRelation(pi, field, alternative, storedRelation(r, arches, profiles))
+		return nil
+	})
+
+	return err
+}
+
+func (db *PostgresDb) GetReverseRelations(ctx context.Context, version, arch, name string) ([]ReverseDependency, error) {
+	var rdeps []ReverseDependency
+	err := db.run(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, `SELECT package, package_version, field, name, arch_qualifier, op, rel_version, arches, profiles FROM relation
+				WHERE version = $1 AND arch = $2 AND name = $3
+				ORDER BY package, field`, version, arch, name)
+		if err != nil {
+			return err
+		}
+
+		var rd ReverseDependency
+		var arches, profiles string
+		_, err = pgx.ForEachRow(rows, []any{&rd.Package, &rd.Version, &rd.Field, &rd.Relation.Name, &rd.Relation.ArchQualifier,
+			&rd.Relation.Op, &rd.Relation.Version, &arches, &profiles}, func() error {
+			rd.Relation = storedRelation(rd.Relation, arches, profiles)
+			rdeps = append(rdeps, rd)
+			return nil
+		})
+		return err
+	})
+
+	return rdeps, err
+}
+
+func (db *PostgresDb) InsertPackagePopularity(ctx context.Context, version, pkg string, popularity uint) error {
+	return db.exec(ctx, `INSERT INTO popularity (version, package, popularity) VALUES ($1, $2, $3)
+			ON CONFLICT (version, package) DO UPDATE SET popularity = EXCLUDED.popularity`, version, pkg, int64(popularity))
+}
+
+func (db *PostgresDb) RemoveAllPopularities(ctx context.Context, version string) error {
+	return db.exec(ctx, "DELETE FROM popularity WHERE version = $1", version)
+}
+
+func (db *PostgresDb) GetPackagePopularity(ctx context.Context, version, pkg string) (uint, error) {
+	var popularity int64
+	err := db.run(ctx, func(q pgQuerier) error {
+		err := q.QueryRow(ctx, "SELECT popularity FROM popularity WHERE version = $1 AND package = $2", version, pkg).Scan(&popularity)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+
+	return uint(popularity), err
+}
+
+func (db *PostgresDb) SetRelease(ctx context.Context, version string, updated time.Time, content, signature []byte) error {
+	return db.exec(ctx, `INSERT INTO release (version, updated, content, signature) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (version) DO UPDATE SET updated = EXCLUDED.updated, content = EXCLUDED.content, signature = EXCLUDED.signature`,
+		version, updated.Unix(), content, signature)
+}
+
+func (db *PostgresDb) GetRelease(ctx context.Context, version string) (time.Time, []byte, []byte, error) {
+	var updated int64
+	var content, signature []byte
+	err := db.run(ctx, func(q pgQuerier) error {
+		return q.QueryRow(ctx, "SELECT updated, content, signature FROM release WHERE version = $1", version).Scan(&updated, &content, &signature)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil, nil, fmt.Errorf("%w: release of %s", ErrNotFound, version)
+	}
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+
+	return time.Unix(updated, 0), content, signature, nil
+}
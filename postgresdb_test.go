@@ -0,0 +1,115 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// newTestPostgresDb opens a PostgresDb in a new schema of the database
+// GODEBIAN_TEST_POSTGRES, e.g. "postgres:///godebian_test", and skips the
+// test if it is not set.
+func newTestPostgresDb(t *testing.T) (*PostgresDb, string) {
+	dsn := os.Getenv("GODEBIAN_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("GODEBIAN_TEST_POSTGRES is not set")
+	}
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("godebian_test_%d", time.Now().UnixNano())
+	_, err = conn.Exec(ctx, "CREATE SCHEMA "+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		conn.Close(context.Background())
+	})
+
+	// extensions like pg_trgm are usually installed in public
+	if strings.Contains(dsn, "://") && strings.Contains(dsn, "?") {
+		dsn += "&search_path=" + schema + ",public"
+	} else if strings.Contains(dsn, "://") {
+		dsn += "?search_path=" + schema + ",public"
+	} else {
+		dsn += " search_path=" + schema + ",public"
+	}
+
+	d, err := OpenPostgresDb(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+
+	return d, dsn
+}
+
+func TestPostgresDbConformance(t *testing.T) {
+	d, _ := newTestPostgresDb(t)
+	testDbConformance(t, d)
+}
+
+func TestPostgresDbTransactions(t *testing.T) {
+	d, _ := newTestPostgresDb(t)
+	testDbTransactions(t, d)
+}
+
+func TestPostgresDbLockSuite(t *testing.T) {
+	d, _ := newTestPostgresDb(t)
+	testSuiteLocker(t, d)
+}
+
+func TestPostgresDbBulkInsert(t *testing.T) {
+	d, _ := newTestPostgresDb(t)
+	ctx := context.Background()
+	dc := DebianContents{db: d, distroWithVersion: "debian/stable"}
+
+	err := dc.readContentsFileIntoDB(ctx, strings.NewReader("usr/bin/foo\tutils/foo\nusr/share/doc/foo/copyright\tutils/foo,doc/foo-doc\n"), "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files that are already indexed are skipped
+	err = dc.readContentsFileIntoDB(ctx, strings.NewReader("usr/bin/foo\tutils/foo\nusr/bin/bar\tutils/bar\n"), "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/usr/bin/foo":       "foo",
+		"/usr/bin/bar":       "bar",
+		"foo/copyright":      "foo foo-doc",
+		"/usr/share/doc/foo": "",
+	} {
+		pkgs, err := d.GetPackage(ctx, "debian/stable", path)
+		sort.Strings(pkgs)
+		if err != nil || strings.Join(pkgs, " ") != want {
+			t.Errorf("packages of %s should be %q, but are %v (%v)", path, want, pkgs, err)
+		}
+	}
+}
+
+func TestOpenPostgresDbRefusesNewerSchema(t *testing.T) {
+	d, dsn := newTestPostgresDb(t)
+	ctx := context.Background()
+
+	_, err := d.pool.Exec(ctx, "UPDATE schema_version SET version = version + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenPostgresDb(ctx, dsn)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening a newer postgres db should fail with ErrSchemaTooNew, but error is %v", err)
+	}
+}
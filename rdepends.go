@@ -0,0 +1,139 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ReverseDependency is a relation of Package to the package it was looked up
+// for, or to a virtual package that one provides.
+type ReverseDependency struct {
+	Package string
+	Version string
+	// Field is the relation field, e.g. "Depends".
+	Field    string
+	Relation Relation
+}
+
+// ReverseDepends returns the packages that have a relation of one of the
+// kinds, e.g. "Depends" or "Recommends", to pkg or to a virtual package pkg
+// provides; kinds default to Depends and Pre-Depends.
+func (d DebianContents) ReverseDepends(pkg string, kinds ...string) ([]ReverseDependency, error) {
+	return d.ReverseDependsContext(context.Background(), pkg, kinds...)
+}
+
+// ReverseDependsContext is like ReverseDepends, but uses ctx for the database
+// queries.
+func (d DebianContents) ReverseDependsContext(ctx context.Context, pkg string, kinds ...string) ([]ReverseDependency, error) {
+	return d.reverseDepends(ctx, pkg, false, kinds)
+}
+
+// TransitiveReverseDepends is like ReverseDepends, but also returns the
+// reverse dependencies of the reverse dependencies.
+func (d DebianContents) TransitiveReverseDepends(pkg string, kinds ...string) ([]ReverseDependency, error) {
+	return d.TransitiveReverseDependsContext(context.Background(), pkg, kinds...)
+}
+
+// TransitiveReverseDependsContext is like TransitiveReverseDepends, but uses
+// ctx for the database queries.
+func (d DebianContents) TransitiveReverseDependsContext(ctx context.Context, pkg string, kinds ...string) ([]ReverseDependency, error) {
+	return d.reverseDepends(ctx, pkg, true, kinds)
+}
+
+func (d DebianContents) reverseDepends(ctx context.Context, pkg string, transitive bool, kinds []string) ([]ReverseDependency, error) {
+	if len(kinds) == 0 {
+		kinds = []string{"Depends", "Pre-Depends"}
+	}
+	wanted := make(map[string]bool)
+	for _, kind := range kinds {
+		if !contains(RelationFields, kind) {
+			return nil, fmt.Errorf("unknown relation field %s", kind)
+		}
+		wanted[kind] = true
+	}
+
+	var rdeps []ReverseDependency
+	seen := make(map[string]bool)
+	visited := map[string]bool{pkg: true}
+	queue := []string{pkg}
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+
+		names, err := d.providedNames(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			for _, arch := range d.lookupArches() {
+				relations, err := d.db.GetReverseRelations(ctx, d.distroWithVersion, arch, name)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, rd := range relations {
+					if !wanted[rd.Field] {
+						continue
+					}
+
+					key := rd.Package + "\x00" + rd.Field + "\x00" + rd.Relation.String()
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+					rdeps = append(rdeps, rd)
+
+					if transitive && !visited[rd.Package] {
+						visited[rd.Package] = true
+						queue = append(queue, rd.Package)
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(rdeps, func(i, j int) bool {
+		if rdeps[i].Package != rdeps[j].Package {
+			return rdeps[i].Package < rdeps[j].Package
+		}
+		return rdeps[i].Field < rdeps[j].Field
+	})
+
+	return rdeps, nil
+}
+
+// lookupArches are the architectures whose package infos are looked up.
+func (d DebianContents) lookupArches() []string {
+	if d.arch == "all" {
+		return []string{"all"}
+	}
+
+	return []string{d.arch, "all"}
+}
+
+// providedNames returns pkg and the virtual packages it provides.
+func (d DebianContents) providedNames(ctx context.Context, pkg string) ([]string, error) {
+	names := []string{pkg}
+
+	for _, arch := range d.lookupArches() {
+		pi, err := d.db.GetPackageInfo(ctx, d.distroWithVersion, arch, pkg)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, alternatives := range pi.Provides {
+			for _, rel := range alternatives {
+				names = append(names, rel.Name)
+			}
+		}
+		break
+	}
+
+	return names, nil
+}
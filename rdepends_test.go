@@ -0,0 +1,57 @@
+package godebian
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func formatReverseDependencies(rdeps []ReverseDependency) string {
+	var ss []string
+	for _, rdep := range rdeps {
+		ss = append(ss, fmt.Sprintf("%s %s %s", rdep.Package, rdep.Field, rdep.Relation))
+	}
+
+	return strings.Join(ss, ", ")
+}
+
+func TestReverseDepends(t *testing.T) {
+	dc := newTestResolveContents(t)
+
+	rdeps, err := dc.ReverseDepends("libc6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatReverseDependencies(rdeps); s != "app Depends libc6 (>= 2.36), postfix Depends libc6, tool Depends libc6 (>= 3.0)" {
+		t.Errorf("unexpected reverse dependencies of libc6: %s", s)
+	}
+
+	rdeps, err = dc.ReverseDepends("postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatReverseDependencies(rdeps); s != "app Depends mail-transport-agent, mailutils Depends postfix" {
+		t.Errorf("reverse dependencies of postfix should include those of the virtual packages it provides, but are: %s", s)
+	}
+
+	rdeps, err = dc.TransitiveReverseDepends("libc6", "Depends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatReverseDependencies(rdeps); s != "app Depends libc6 (>= 2.36), app Depends mail-transport-agent, mailutils Depends postfix, postfix Depends libc6, tool Depends libc6 (>= 3.0)" {
+		t.Errorf("unexpected transitive reverse dependencies of libc6: %s", s)
+	}
+
+	rdeps, err = dc.ReverseDepends("exim4", "Conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatReverseDependencies(rdeps); s != "exim4 Conflicts mail-transport-agent, postfix Conflicts mail-transport-agent" {
+		t.Errorf("unexpected conflicts with exim4: %s", s)
+	}
+
+	_, err = dc.ReverseDepends("libc6", "Depend")
+	if err == nil {
+		t.Errorf("unknown relation field should fail")
+	}
+}
@@ -0,0 +1,191 @@
+package godebian
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RelationFields are the fields of a Packages stanza that contain relations
+// to other packages.
+var RelationFields = []string{"Depends", "Pre-Depends", "Recommends", "Suggests", "Conflicts", "Breaks", "Replaces", "Provides", "Enhances"}
+
+// Relation is a relation to a single package, e.g.
+// "python3:any (>= 3.11) [amd64 !i386] <!nocheck>".
+type Relation struct {
+	Name string
+	// ArchQualifier is the architecture after the colon of the name, e.g.
+	// "any" or "native".
+	ArchQualifier string
+	// Op is one of "<<", "<=", "=", ">=" and ">>", or empty if the relation
+	// has no version constraint.
+	Op      string
+	Version string
+	// Arches is the architecture restriction list; entries starting with "!"
+	// exclude an architecture.
+	Arches []string
+	// Profiles are the build profile restriction formulas; the relation
+	// applies if any of them is satisfied.
+	Profiles [][]string
+}
+
+// Alternatives are relations separated by "|"; any of them satisfies the
+// dependency.
+type Alternatives []Relation
+
+func (r Relation) String() string {
+	var sb strings.Builder
+
+	sb.WriteString(r.Name)
+	if r.ArchQualifier != "" {
+		sb.WriteString(":" + r.ArchQualifier)
+	}
+	if r.Op != "" {
+		fmt.Fprintf(&sb, " (%s %s)", r.Op, r.Version)
+	}
+	if len(r.Arches) > 0 {
+		fmt.Fprintf(&sb, " [%s]", strings.Join(r.Arches, " "))
+	}
+	if len(r.Profiles) > 0 {
+		sb.WriteString(" " + formatProfiles(r.Profiles))
+	}
+
+	return sb.String()
+}
+
+func (a Alternatives) String() string {
+	ss := make([]string, len(a))
+	for i, r := range a {
+		ss[i] = r.String()
+	}
+
+	return strings.Join(ss, " | ")
+}
+
+// formatRelations returns relations in the format of a Depends field.
+func formatRelations(relations []Alternatives) string {
+	ss := make([]string, len(relations))
+	for i, a := range relations {
+		ss[i] = a.String()
+	}
+
+	return strings.Join(ss, ", ")
+}
+
+// formatProfiles returns build profile restriction formulas in the format of
+// a relation, e.g. "<!nocheck> <stage1 cross>".
+func formatProfiles(profiles [][]string) string {
+	ss := make([]string, len(profiles))
+	for i, profile := range profiles {
+		ss[i] = "<" + strings.Join(profile, " ") + ">"
+	}
+
+	return strings.Join(ss, " ")
+}
+
+// parseProfiles is the inverse of formatProfiles.
+func parseProfiles(s string) [][]string {
+	var profiles [][]string
+	for _, formula := range strings.Split(s, ">") {
+		formula = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(formula), "<"))
+		if formula != "" {
+			profiles = append(profiles, strings.Fields(formula))
+		}
+	}
+
+	return profiles
+}
+
+// ParseRelations parses the value of a relation field like Depends.
+func ParseRelations(value string) ([]Alternatives, error) {
+	var relations []Alternatives
+	for _, group := range strings.Split(value, ",") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+
+		var alternatives Alternatives
+		for _, s := range strings.Split(group, "|") {
+			r, err := ParseRelation(s)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, r)
+		}
+		relations = append(relations, alternatives)
+	}
+
+	return relations, nil
+}
+
+var relationOps = map[string]string{
+	"<<": "<<",
+	"<=": "<=",
+	"=":  "=",
+	">=": ">=",
+	">>": ">>",
+	// obsolete forms, see deb-control(5)
+	"<": "<=",
+	">": ">=",
+}
+
+// ParseRelation parses a single relation without alternatives.
+func ParseRelation(s string) (Relation, error) {
+	var r Relation
+
+	rest := strings.TrimSpace(s)
+	end := strings.IndexAny(rest, " \t\n([<")
+	if end < 0 {
+		end = len(rest)
+	}
+	r.Name, r.ArchQualifier, _ = strings.Cut(rest[:end], ":")
+	if r.Name == "" {
+		return r, fmt.Errorf("relation without package name: %q", s)
+	}
+	rest = strings.TrimSpace(rest[end:])
+
+	for rest != "" {
+		var closing byte
+		switch rest[0] {
+		case '(':
+			closing = ')'
+		case '[':
+			closing = ']'
+		case '<':
+			closing = '>'
+		default:
+			return r, fmt.Errorf("invalid relation %q", s)
+		}
+
+		end := strings.IndexByte(rest, closing)
+		if end < 0 {
+			return r, fmt.Errorf("missing %q in relation %q", closing, s)
+		}
+		content := strings.TrimSpace(rest[1:end])
+
+		switch rest[0] {
+		case '(':
+			opEnd := strings.IndexFunc(content, func(c rune) bool {
+				return !strings.ContainsRune("<=>", c)
+			})
+			if opEnd < 0 {
+				opEnd = len(content)
+			}
+			op, ok := relationOps[content[:opEnd]]
+			if !ok {
+				return r, fmt.Errorf("invalid version constraint in relation %q", s)
+			}
+			r.Op = op
+			r.Version = strings.TrimSpace(content[opEnd:])
+			if r.Version == "" {
+				return r, fmt.Errorf("version constraint without version in relation %q", s)
+			}
+		case '[':
+			r.Arches = strings.Fields(content)
+		case '<':
+			r.Profiles = append(r.Profiles, strings.Fields(content))
+		}
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+
+	return r, nil
+}
@@ -0,0 +1,34 @@
+package godebian
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseRelations(t *testing.T) {
+	relations, err := ParseRelations("libc6 (>= 2.36), python3:any (<< 3.13~) | python3-minimal,\n debhelper-compat (= 13) [amd64 !i386] <!nocheck> <stage1 cross>, foo (> 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Alternatives{
+		{{Name: "libc6", Op: ">=", Version: "2.36"}},
+		{{Name: "python3", ArchQualifier: "any", Op: "<<", Version: "3.13~"}, {Name: "python3-minimal"}},
+		{{Name: "debhelper-compat", Op: "=", Version: "13", Arches: []string{"amd64", "!i386"}, Profiles: [][]string{{"!nocheck"}, {"stage1", "cross"}}}},
+		{{Name: "foo", Op: ">=", Version: "1"}},
+	}
+	if fmt.Sprintf("%#v", relations) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("relations should be %+v, but are %+v", expected, relations)
+	}
+
+	formatted := formatRelations(relations)
+	if formatted != "libc6 (>= 2.36), python3:any (<< 3.13~) | python3-minimal, debhelper-compat (= 13) [amd64 !i386] <!nocheck> <stage1 cross>, foo (>= 1)" {
+		t.Errorf("unexpected formatted relations %q", formatted)
+	}
+
+	for _, invalid := range []string{"foo (>= 1", "foo (~ 1)", "foo (>=)", "(>= 1)", "foo bar"} {
+		if _, err := ParseRelations(invalid); err == nil {
+			t.Errorf("%q should not parse", invalid)
+		}
+	}
+}
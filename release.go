@@ -0,0 +1,328 @@
+package godebian
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// ReleaseFile is an index file listed in the SHA256 section of a Release file.
+type ReleaseFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// Release is the parsed content of a dists/<suite>/Release or InRelease file.
+type Release struct {
+	Origin        string
+	Label         string
+	Suite         string
+	Codename      string
+	Version       string
+	Date          time.Time
+	ValidUntil    time.Time
+	Architectures []string
+	Components    []string
+	// SHA256 is keyed by the path relative to dists/<suite>/, e.g. "main/Contents-amd64.gz".
+	SHA256 map[string]ReleaseFile
+
+	// raw is the Release file as it was parsed, including its signature.
+	raw []byte
+	// signature is the content of Release.gpg if raw is not clearsigned and
+	// its signature was checked.
+	signature []byte
+}
+
+var releaseDateFormats = []string{
+	time.RFC1123,
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+}
+
+func parseReleaseDate(s string) (time.Time, error) {
+	var err error
+	for _, format := range releaseDateFormats {
+		var t time.Time
+		t, err = time.Parse(format, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+// ParseRelease parses a Release file; clearsigned InRelease files are
+// accepted as well, but their signature is not checked.
+func ParseRelease(r io.Reader) (*Release, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rel := &Release{SHA256: make(map[string]ReleaseFile), raw: data}
+	var field string
+
+	if b, _ := clearsign.Decode(data); b != nil {
+		data = b.Plaintext
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if field != "SHA256" {
+				continue
+			}
+			ss := strings.Fields(line)
+			if len(ss) != 3 {
+				return nil, fmt.Errorf("invalid SHA256 line in Release file: %q", line)
+			}
+			size, err := strconv.ParseInt(ss[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in Release file line %q: %v", line, err)
+			}
+			rel.SHA256[ss[2]] = ReleaseFile{Path: ss[2], Size: size, SHA256: ss[0]}
+			continue
+		}
+
+		ss := strings.SplitN(line, ":", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("invalid line in Release file: %q", line)
+		}
+		field = ss[0]
+		value := strings.TrimSpace(ss[1])
+
+		switch field {
+		case "Origin":
+			rel.Origin = value
+		case "Label":
+			rel.Label = value
+		case "Suite":
+			rel.Suite = value
+		case "Codename":
+			rel.Codename = value
+		case "Version":
+			rel.Version = value
+		case "Architectures":
+			rel.Architectures = strings.Fields(value)
+		case "Components":
+			rel.Components = strings.Fields(value)
+		case "Date":
+			rel.Date, err = parseReleaseDate(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Date in Release file: %v", err)
+			}
+		case "Valid-Until":
+			rel.ValidUntil, err = parseReleaseDate(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Valid-Until in Release file: %v", err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rel, nil
+}
+
+// indexFile is a Contents or Packages file listed in a Release file.
+type indexFile struct {
+	path      string
+	component string
+	arch      string
+}
+
+// indexFiles returns the Contents and Packages files of the given components
+// and architectures listed in the Release file, picking the best compressed
+// variant of each. Contents files published directly below dists/<suite>/
+// have an empty component.
+func (rel *Release) indexFiles(components, arches []string) (contents []indexFile, packages []indexFile) {
+	best := make(map[string]string)
+	for path := range rel.SHA256 {
+		base, ext := splitCompression(path)
+		current, ok := best[base]
+		if !ok {
+			best[base] = path
+			continue
+		}
+		_, currentExt := splitCompression(current)
+		if compressionRank(ext) < compressionRank(currentExt) {
+			best[base] = path
+		}
+	}
+
+	for base, path := range best {
+		var component string
+		name := base
+		for _, c := range components {
+			if strings.HasPrefix(base, c+"/") {
+				component = c
+				name = strings.TrimPrefix(base, c+"/")
+				break
+			}
+		}
+		if component == "" && strings.Contains(name, "/") {
+			continue
+		}
+
+		if arch, ok := matchIndexName(name, "Contents-", ""); ok && contains(arches, arch) {
+			contents = append(contents, indexFile{path: path, component: component, arch: arch})
+		}
+		if arch, ok := matchIndexName(name, "binary-", "/Packages"); ok && component != "" && contains(arches, arch) {
+			packages = append(packages, indexFile{path: path, component: component, arch: arch})
+		}
+	}
+
+	sort.Slice(contents, func(i, j int) bool { return contents[i].path < contents[j].path })
+	sort.Slice(packages, func(i, j int) bool { return packages[i].path < packages[j].path })
+
+	return contents, packages
+}
+
+// matchIndexName returns the architecture of an uncompressed index file name
+// like "Contents-amd64" or "binary-amd64/Packages".
+func matchIndexName(name, prefix, suffix string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+
+	arch := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+	if arch == "" || strings.Contains(arch, "/") {
+		return "", false
+	}
+
+	return arch, true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReleaseVerification describes how the Release file of a suite was
+// authenticated.
+type ReleaseVerification struct {
+	// Signed is false if no keyring was configured and the Release file was
+	// used without checking its signature.
+	Signed      bool
+	Fingerprint string
+	Signer      string
+	ValidUntil  time.Time
+}
+
+func readKeyring(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// verifyReleaseSignature checks the signature of a clearsigned InRelease
+// file, or of a Release file if sig holds the content of Release.gpg.
+func verifyReleaseSignature(keyring openpgp.KeyRing, data, sig []byte) (ReleaseVerification, error) {
+	var signer *openpgp.Entity
+	var err error
+
+	if sig == nil {
+		b, _ := clearsign.Decode(data)
+		if b == nil {
+			return ReleaseVerification{}, fmt.Errorf("%w: Release file is neither clearsigned nor has a detached signature", ErrBadSignature)
+		}
+		signer, err = b.VerifySignature(keyring, nil)
+	} else {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return ReleaseVerification{}, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	v := ReleaseVerification{
+		Signed:      true,
+		Fingerprint: strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint)),
+	}
+	if id := signer.PrimaryIdentity(); id != nil {
+		v.Signer = id.Name
+	}
+
+	return v, nil
+}
+
+// verifiedFile is a downloaded index file whose size and SHA256 matched the
+// Release file; closing it removes it from disk.
+type verifiedFile struct {
+	*os.File
+}
+
+func (f verifiedFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+
+	return err
+}
+
+// verifyIndexFile copies r into a temporary file and checks it against the
+// Release entry for path.
+func (rel *Release) verifyIndexFile(r io.Reader, path string) (verifiedFile, error) {
+	entry, ok := rel.SHA256[path]
+	if !ok {
+		return verifiedFile{}, fmt.Errorf("%s is not listed in the Release file", path)
+	}
+
+	fp, err := os.CreateTemp("", "godebian-index-*")
+	if err != nil {
+		return verifiedFile{}, err
+	}
+	f := verifiedFile{fp}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return verifiedFile{}, fmt.Errorf("downloading %s failed: %v", path, err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if size != entry.Size || sum != entry.SHA256 {
+		f.Close()
+		return verifiedFile{}, fmt.Errorf("%w: %s has size %d and SHA256 %s, Release file lists size %d and SHA256 %s",
+			ErrChecksumMismatch, path, size, sum, entry.Size, entry.SHA256)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return verifiedFile{}, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,311 @@
+package godebian
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+const testInRelease = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Debian
+Label: Debian
+Suite: stable
+Version: 12.5
+Codename: bookworm
+Date: Sat, 10 Feb 2024 09:48:20 UTC
+Valid-Until: Sat, 17 Feb 2024 09:48:20 UTC
+Architectures: all amd64 arm64
+Components: main contrib non-free-firmware non-free
+Description: Debian 12.5 Released 10 February 2024
+MD5Sum:
+ 0ed6d4c8891eb86358b94bb35d9e4da4  1484322 contrib/Contents-all
+SHA256:
+ %s %d main/Contents-amd64.gz
+ 2b4a7f4e86fd35e1d4b1a4a2d5d3c1f6f3aa13a5d0f6cd26bfe3ebe7f0e0d5b1    88 main/binary-amd64/Packages.gz
+- -not-a-field: dash escaped
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+-----END PGP SIGNATURE-----
+`
+
+func testRelease(t *testing.T, content string) *Release {
+	h := sha256.Sum256([]byte(content))
+	rel, err := ParseRelease(strings.NewReader(fmt.Sprintf(testInRelease, hex.EncodeToString(h[:]), len(content))))
+	if err != nil {
+		t.Fatalf("parsing release failed: %v", err)
+	}
+
+	return rel
+}
+
+func TestParseRelease(t *testing.T) {
+	rel := testRelease(t, "foo")
+
+	if rel.Suite != "stable" || rel.Codename != "bookworm" || rel.Version != "12.5" {
+		t.Fatalf("unexpected release header: %+v", rel)
+	}
+
+	if rel.Date.Day() != 10 || rel.ValidUntil.Day() != 17 {
+		t.Fatalf("unexpected dates: %v %v", rel.Date, rel.ValidUntil)
+	}
+
+	if strings.Join(rel.Components, " ") != "main contrib non-free-firmware non-free" {
+		t.Fatalf("unexpected components: %+v", rel.Components)
+	}
+
+	if strings.Join(rel.Architectures, " ") != "all amd64 arm64" {
+		t.Fatalf("unexpected architectures: %+v", rel.Architectures)
+	}
+
+	if len(rel.SHA256) != 2 {
+		t.Fatalf("SHA256 table should have 2 entries, but is %+v", rel.SHA256)
+	}
+
+	if rel.SHA256["main/binary-amd64/Packages.gz"].Size != 88 {
+		t.Fatalf("unexpected Packages entry: %+v", rel.SHA256["main/binary-amd64/Packages.gz"])
+	}
+}
+
+func TestVerifyIndexFile(t *testing.T) {
+	rel := testRelease(t, "foo")
+
+	f, err := rel.verifyIndexFile(strings.NewReader("foo"), "main/Contents-amd64.gz")
+	if err != nil {
+		t.Fatalf("verifying index file failed: %v", err)
+	}
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "foo" {
+		t.Fatalf("reading verified file returned %q, %v", content, err)
+	}
+
+	_, err = rel.verifyIndexFile(strings.NewReader("bar"), "main/Contents-amd64.gz")
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("modified file should fail with checksum mismatch, but is: %v", err)
+	}
+
+	_, err = rel.verifyIndexFile(strings.NewReader("foo"), "main/Contents-arm64.gz")
+	if err == nil {
+		t.Fatalf("unlisted file should not verify")
+	}
+}
+
+func signedTestRelease(t *testing.T, release string) (inRelease []byte, releaseGPG []byte, keyring string) {
+	entity, err := openpgp.NewEntity("Test Archive", "", "archive@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, entity.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, release)
+	w.Close()
+	inRelease = buf.Bytes()
+
+	var sig bytes.Buffer
+	err = openpgp.ArmoredDetachSign(&sig, entity, strings.NewReader(release), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseGPG = sig.Bytes()
+
+	var pub bytes.Buffer
+	err = entity.Serialize(&pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring = filepath.Join(t.TempDir(), "keyring.gpg")
+	err = os.WriteFile(keyring, pub.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return inRelease, releaseGPG, keyring
+}
+
+func TestFetchSignedRelease(t *testing.T) {
+	release := "Suite: stable\nCodename: bookworm\n"
+	ctx := context.Background()
+	inRelease, releaseGPG, keyring := signedTestRelease(t, release)
+	_, _, otherKeyring := signedTestRelease(t, release)
+
+	files := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	files["/dists/stable/InRelease"] = inRelease
+	rel, v, err := fetchRelease(ctx, srv.URL+"/dists/stable", keyring)
+	if err != nil {
+		t.Fatalf("fetching signed InRelease failed: %v", err)
+	}
+	if rel.Codename != "bookworm" || !v.Signed || v.Signer != "Test Archive <archive@example.org>" {
+		t.Fatalf("unexpected release %+v or verification %+v", rel, v)
+	}
+
+	_, _, err = fetchRelease(ctx, srv.URL+"/dists/stable", otherKeyring)
+	if !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("InRelease signed by unknown key should fail, but is: %v", err)
+	}
+
+	files["/dists/stable/InRelease"] = bytes.Replace(inRelease, []byte("bookworm"), []byte("trixie"), 1)
+	_, _, err = fetchRelease(ctx, srv.URL+"/dists/stable", keyring)
+	if !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("modified InRelease should fail, but is: %v", err)
+	}
+
+	delete(files, "/dists/stable/InRelease")
+	files["/dists/stable/Release"] = []byte(release)
+	files["/dists/stable/Release.gpg"] = releaseGPG
+	rel, v, err = fetchRelease(ctx, srv.URL+"/dists/stable", keyring)
+	if err != nil || !v.Signed {
+		t.Fatalf("fetching Release with detached signature failed: %v", err)
+	}
+	if !bytes.Equal(rel.signature, releaseGPG) {
+		t.Fatalf("Release file should keep its detached signature for storing it")
+	}
+
+	files["/dists/stable/Release"] = []byte(release + "Valid-Until: Sat, 17 Feb 2024 09:48:20 UTC\n")
+	_, v, err = fetchRelease(ctx, srv.URL+"/dists/stable", "")
+	if !errors.Is(err, ErrReleaseExpired) || v.Signed {
+		t.Fatalf("expired Release file should fail, but is: %v", err)
+	}
+}
+
+func TestReleaseIndexFiles(t *testing.T) {
+	rel := &Release{SHA256: make(map[string]ReleaseFile)}
+	for _, path := range []string{
+		"Contents-amd64.gz",
+		"Contents-i386.gz",
+		"main/Contents-amd64",
+		"main/Contents-amd64.gz",
+		"main/Contents-amd64.xz",
+		"main/Contents-udeb-amd64.gz",
+		"main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.gz",
+		"main/binary-amd64/Release",
+		"main/debian-installer/binary-amd64/Packages.gz",
+		"non-free-firmware/Contents-all.gz",
+		"non-free-firmware/binary-all/Packages",
+		"contrib/Contents-arm64.gz",
+		"contrib/binary-arm64/Packages.gz",
+		"unknown/binary-amd64/Packages.gz",
+	} {
+		rel.SHA256[path] = ReleaseFile{Path: path}
+	}
+
+	contents, packages := rel.indexFiles([]string{"main", "contrib", "non-free-firmware"}, []string{"amd64", "all"})
+
+	expectedContents := []indexFile{
+		{path: "Contents-amd64.gz", arch: "amd64"},
+		{path: "main/Contents-amd64.xz", component: "main", arch: "amd64"},
+		{path: "non-free-firmware/Contents-all.gz", component: "non-free-firmware", arch: "all"},
+	}
+	expectedPackages := []indexFile{
+		{path: "main/binary-amd64/Packages.gz", component: "main", arch: "amd64"},
+		{path: "non-free-firmware/binary-all/Packages", component: "non-free-firmware", arch: "all"},
+	}
+
+	if fmt.Sprint(contents) != fmt.Sprint(expectedContents) {
+		t.Fatalf("contents files should be %+v, but are %+v", expectedContents, contents)
+	}
+	if fmt.Sprint(packages) != fmt.Sprint(expectedPackages) {
+		t.Fatalf("packages files should be %+v, but are %+v", expectedPackages, packages)
+	}
+}
+
+func TestOpenContentsVerifiesStoredRelease(t *testing.T) {
+	ctx := context.Background()
+	release := "Suite: stable\nCodename: bookworm\n"
+	inRelease, releaseGPG, keyring := signedTestRelease(t, release)
+	_, _, otherKeyring := signedTestRelease(t, release)
+
+	opts := ContentsOptions{Distro: "debian", Suite: "stable", Keyring: keyring}
+	db := NewMemoryDb()
+	err := db.SetRelease(ctx, "debian/stable", time.Now(), inRelease, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := OpenContents(opts, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := dc.ReleaseVerification(); !v.Signed || v.Signer != "Test Archive <archive@example.org>" {
+		t.Errorf("stored InRelease should be verified again, but verification is %+v", v)
+	}
+
+	opts.Keyring = otherKeyring
+	dc, err = OpenContents(opts, db)
+	if !errors.Is(err, ErrBadSignature) || !dc.LastUpdate().IsZero() || dc.Release() != nil {
+		t.Errorf("stored InRelease signed by unknown key should be rejected, but error is %v", err)
+	}
+
+	// a Release file is verified with its stored detached signature
+	opts.Keyring = keyring
+	err = db.SetRelease(ctx, "debian/stable", time.Now(), []byte(release), releaseGPG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err = OpenContents(opts, db)
+	if err != nil || !dc.ReleaseVerification().Signed || dc.Release() == nil {
+		t.Errorf("stored Release file should be verified with Release.gpg, but is %+v (%v)", dc.ReleaseVerification(), err)
+	}
+
+	opts.Keyring = otherKeyring
+	dc, err = OpenContents(opts, db)
+	if !errors.Is(err, ErrBadSignature) || dc.Release() != nil {
+		t.Errorf("stored Release file signed by unknown key should be rejected, but error is %v", err)
+	}
+
+	opts.Keyring = keyring
+	err = db.SetRelease(ctx, "debian/stable", time.Now(), []byte(release), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err = OpenContents(opts, db)
+	if !errors.Is(err, ErrBadSignature) || dc.Release() != nil {
+		t.Errorf("stored Release file without signature should be rejected with a keyring, but error is %v", err)
+	}
+
+	opts.Keyring = ""
+	dc, err = OpenContents(opts, db)
+	if err != nil || dc.ReleaseVerification().Signed || dc.Release() == nil {
+		t.Errorf("stored Release file should be used unsigned without a keyring, but is %+v (%v)", dc.ReleaseVerification(), err)
+	}
+
+	err = db.SetRelease(ctx, "debian/stable", time.Now(), []byte(release+"Valid-Until: Sat, 17 Feb 2024 09:48:20 UTC\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err = OpenContents(opts, db)
+	if !errors.Is(err, ErrReleaseExpired) || !dc.Stale(time.Hour) {
+		t.Errorf("expired stored Release file should be rejected and the index stale, but error is %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnsatisfiedRelation is a Depends or Pre-Depends entry that no indexed
+// package satisfies.
+type UnsatisfiedRelation struct {
+	Package  string
+	Field    string
+	Relation Alternatives
+}
+
+// ConflictingRelation is a Conflicts or Breaks entry of Package that matches
+// the package With of the install set.
+type ConflictingRelation struct {
+	Package  string
+	Field    string
+	Relation Relation
+	With     string
+}
+
+// ResolveError lists the relations that prevent a consistent install set.
+type ResolveError struct {
+	Unsatisfied []UnsatisfiedRelation
+	Conflicts   []ConflictingRelation
+}
+
+func (e *ResolveError) Error() string {
+	var ss []string
+	for _, u := range e.Unsatisfied {
+		ss = append(ss, fmt.Sprintf("%s %s %s is not satisfiable", u.Package, u.Field, u.Relation))
+	}
+	for _, c := range e.Conflicts {
+		ss = append(ss, fmt.Sprintf("%s %s %s, but %s is installed", c.Package, c.Field, c.Relation, c.With))
+	}
+
+	return "resolving dependencies failed: " + strings.Join(ss, "; ")
+}
+
+// resolver computes the install set of packages of a DebianContents.
+type resolver struct {
+	ctx     context.Context
+	d       DebianContents
+	install map[string]PackageInfo
+	queue   []PackageInfo
+	err     ResolveError
+}
+
+// Resolve returns the packages that have to be installed for pkgs, including
+// pkgs themselves, sorted by name. It follows Pre-Depends and Depends,
+// prefers the most popular package of the alternatives and considers virtual
+// packages. If relations can't be satisfied or packages of the install set
+// conflict, the error is a *ResolveError and the returned install set is
+// incomplete.
+func (d DebianContents) Resolve(pkgs ...string) ([]PackageInfo, error) {
+	return d.ResolveContext(context.Background(), pkgs...)
+}
+
+// ResolveContext is like Resolve, but uses ctx for the database queries.
+func (d DebianContents) ResolveContext(ctx context.Context, pkgs ...string) ([]PackageInfo, error) {
+	r := resolver{ctx: ctx, d: d, install: make(map[string]PackageInfo)}
+
+	for _, pkg := range pkgs {
+		pi, err := r.lookup(pkg)
+		if err != nil {
+			return nil, err
+		}
+		r.add(pi)
+	}
+
+	for len(r.queue) > 0 {
+		pi := r.queue[0]
+		r.queue = r.queue[1:]
+
+		for _, field := range []string{"Pre-Depends", "Depends"} {
+			for _, alternatives := range pi.Relations(field) {
+				err := r.resolve(pi, field, alternatives)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	err := r.checkConflicts()
+	if err != nil {
+		return nil, err
+	}
+
+	var installSet []PackageInfo
+	for _, pi := range r.install {
+		installSet = append(installSet, pi)
+	}
+	sort.Slice(installSet, func(i, j int) bool {
+		return installSet[i].Name < installSet[j].Name
+	})
+
+	if len(r.err.Unsatisfied) > 0 || len(r.err.Conflicts) > 0 {
+		return installSet, &r.err
+	}
+
+	return installSet, nil
+}
+
+// lookup returns the package info of pkg, which might only be indexed for
+// the architecture "all".
+func (r *resolver) lookup(pkg string) (PackageInfo, error) {
+	var pi PackageInfo
+	var err error
+	for _, arch := range r.d.lookupArches() {
+		pi, err = r.d.db.GetPackageInfo(r.ctx, r.d.distroWithVersion, arch, pkg)
+		if !errors.Is(err, ErrNotFound) {
+			break
+		}
+	}
+
+	return pi, err
+}
+
+func (r *resolver) add(pi PackageInfo) {
+	if _, ok := r.install[pi.Name]; ok {
+		return
+	}
+
+	r.install[pi.Name] = pi
+	r.queue = append(r.queue, pi)
+}
+
+// resolve adds a package satisfying alternatives to the install set unless
+// one is installed already.
+func (r *resolver) resolve(pi PackageInfo, field string, alternatives Alternatives) error {
+	var candidates []PackageInfo
+	applies := false
+	for _, rel := range alternatives {
+		if !r.appliesToArch(rel) {
+			continue
+		}
+		applies = true
+
+		satisfying, err := r.candidates(rel)
+		if err != nil {
+			return err
+		}
+		for _, c := range satisfying {
+			if _, ok := r.install[c.Name]; ok {
+				return nil
+			}
+		}
+		candidates = append(candidates, satisfying...)
+	}
+
+	if !applies {
+		return nil
+	}
+	if len(candidates) == 0 {
+		r.err.Unsatisfied = append(r.err.Unsatisfied, UnsatisfiedRelation{Package: pi.Name, Field: field, Relation: alternatives})
+		return nil
+	}
+
+	best, err := r.mostPopular(candidates)
+	if err != nil {
+		return err
+	}
+	r.add(best)
+
+	return nil
+}
+
+// appliesToArch reports whether rel applies to the indexed architecture.
+func (r *resolver) appliesToArch(rel Relation) bool {
+	if len(rel.Arches) == 0 {
+		return true
+	}
+
+	negated := strings.HasPrefix(rel.Arches[0], "!")
+	for _, arch := range rel.Arches {
+		if strings.TrimPrefix(arch, "!") == r.d.arch {
+			return !negated
+		}
+	}
+
+	return negated
+}
+
+// candidates returns the real and the virtual packages that satisfy rel.
+func (r *resolver) candidates(rel Relation) ([]PackageInfo, error) {
+	var candidates []PackageInfo
+
+	pi, err := r.lookup(rel.Name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && r.satisfies(pi, rel) {
+		candidates = append(candidates, pi)
+	}
+
+	providers, err := r.providers(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(candidates, providers...), nil
+}
+
+// satisfies reports whether the real package pi satisfies rel.
+func (r *resolver) satisfies(pi PackageInfo, rel Relation) bool {
+	switch rel.ArchQualifier {
+	case "", "native", r.d.arch:
+	case "any":
+		if pi.MultiArch != "allowed" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if rel.Op == "" {
+		return true
+	}
+
+	v, err := ParseVersion(pi.Version)
+	if err != nil {
+		return false
+	}
+
+	return rel.SatisfiedBy(v)
+}
+
+// providers returns the packages whose Provides satisfy rel; versioned
+// relations are only satisfied by versioned Provides.
+func (r *resolver) providers(rel Relation) ([]PackageInfo, error) {
+	var providers []PackageInfo
+
+	for _, arch := range r.d.lookupArches() {
+		relations, err := r.d.db.GetReverseRelations(r.ctx, r.d.distroWithVersion, arch, rel.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rd := range relations {
+			if rd.Field != "Provides" {
+				continue
+			}
+			if rel.Op != "" {
+				v, err := ParseVersion(rd.Relation.Version)
+				if rd.Relation.Op != "=" || err != nil || !rel.SatisfiedBy(v) {
+					continue
+				}
+			}
+
+			pi, err := r.lookup(rd.Package)
+			if err != nil {
+				return nil, err
+			}
+			if pi.Version == rd.Version {
+				providers = append(providers, pi)
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+// mostPopular returns the candidate with the best popcon rank; candidates
+// without rank come last, ties are broken by the order of candidates.
+func (r *resolver) mostPopular(candidates []PackageInfo) (PackageInfo, error) {
+	best := candidates[0]
+	var bestRank uint
+
+	for _, c := range candidates {
+		rank, err := r.d.db.GetPackagePopularity(r.ctx, r.d.distroWithVersion, c.Name)
+		if err != nil {
+			return best, err
+		}
+		if rank != 0 && (bestRank == 0 || rank < bestRank) {
+			best, bestRank = c, rank
+		}
+	}
+
+	return best, nil
+}
+
+// checkConflicts records the Conflicts and Breaks relations between packages
+// of the install set.
+func (r *resolver) checkConflicts() error {
+	var names []string
+	for name := range r.install {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pi := r.install[name]
+		for _, field := range []string{"Conflicts", "Breaks"} {
+			for _, alternatives := range pi.Relations(field) {
+				for _, rel := range alternatives {
+					if !r.appliesToArch(rel) {
+						continue
+					}
+
+					matching, err := r.candidates(rel)
+					if err != nil {
+						return err
+					}
+					for _, m := range matching {
+						// packages may conflict with a virtual package they provide
+						if m.Name == pi.Name {
+							continue
+						}
+						if _, ok := r.install[m.Name]; ok {
+							r.err.Conflicts = append(r.err.Conflicts, ConflictingRelation{Package: pi.Name, Field: field, Relation: rel, With: m.Name})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testResolvePackages = `Package: app
+Version: 1.0
+Pre-Depends: init-system-helpers
+Depends: libc6 (>= 2.36), mail-transport-agent, python3:any | perl, libfoo1 [!amd64]
+
+Package: libc6
+Version: 2.36-9
+Multi-Arch: same
+
+Package: postfix
+Version: 3.7
+Depends: libc6
+Provides: mail-transport-agent
+Conflicts: mail-transport-agent
+
+Package: exim4
+Version: 4.96
+Provides: mail-transport-agent
+Conflicts: mail-transport-agent
+
+Package: python3
+Version: 3.11
+Multi-Arch: allowed
+
+Package: perl
+Version: 5.36
+
+Package: mailutils
+Version: 1.0
+Depends: postfix
+
+Package: tool
+Version: 1.0
+Depends: libc6 (>= 3.0), perl:any
+`
+
+const testResolveAllPackages = `Package: init-system-helpers
+Version: 1.65
+`
+
+func newTestResolveContents(t *testing.T) DebianContents {
+	ctx := context.Background()
+	dc := DebianContents{db: newTestDb(t), distroWithVersion: "debian/stable", arch: "amd64"}
+
+	err := dc.readPackagesFileIntoDB(ctx, strings.NewReader(testResolvePackages), "main", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dc.readPackagesFileIntoDB(ctx, strings.NewReader(testResolveAllPackages), "main", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pkg, rank := range map[string]uint{"exim4": 5, "postfix": 2, "perl": 1, "python3": 3} {
+		err = dc.db.InsertPackagePopularity(ctx, dc.distroWithVersion, pkg, rank)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dc
+}
+
+func packageNames(pis []PackageInfo) string {
+	var names []string
+	for _, pi := range pis {
+		names = append(names, pi.Name)
+	}
+
+	return strings.Join(names, " ")
+}
+
+func TestResolve(t *testing.T) {
+	dc := newTestResolveContents(t)
+
+	installSet, err := dc.Resolve("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := packageNames(installSet); names != "app init-system-helpers libc6 perl postfix" {
+		t.Errorf("unexpected install set %s", names)
+	}
+
+	installSet, err = dc.Resolve("app", "exim4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := packageNames(installSet); names != "app exim4 init-system-helpers libc6 perl" {
+		t.Errorf("installed exim4 should satisfy mail-transport-agent, but install set is %s", names)
+	}
+
+	installSet, err = dc.Resolve("mailutils", "exim4")
+	var resolveErr *ResolveError
+	if !errors.As(err, &resolveErr) || len(resolveErr.Conflicts) != 2 || len(resolveErr.Unsatisfied) != 0 {
+		t.Fatalf("exim4 and postfix should conflict, but error is %v", err)
+	}
+	if c := resolveErr.Conflicts[0]; c.Package != "exim4" || c.Field != "Conflicts" || c.With != "postfix" {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+	if names := packageNames(installSet); names != "exim4 libc6 mailutils postfix" {
+		t.Errorf("unexpected install set %s", names)
+	}
+
+	_, err = dc.Resolve("tool")
+	if !errors.As(err, &resolveErr) || len(resolveErr.Unsatisfied) != 2 {
+		t.Fatalf("tool should have 2 unsatisfied dependencies, but error is %v", err)
+	}
+	if u := resolveErr.Unsatisfied[0]; u.Package != "tool" || u.Field != "Depends" || u.Relation.String() != "libc6 (>= 3.0)" {
+		t.Errorf("unexpected unsatisfied relation %+v", u)
+	}
+
+	_, err = dc.Resolve("unknown")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown package should not be found, but is: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package godebian
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration changes the schema of a database from the version of the
+// previous migration to its own version, its position in migrations plus
+// one. Databases written before schema versions were introduced have version
+// 0 in any state of the schema, so migrations must be idempotent.
+type migration struct {
+	description string
+	migrate     func(tx *sql.Tx) error
+	// vacuum is set if the migration frees a lot of space
+	vacuum bool
+}
+
+// migrations are applied in order; new migrations are appended.
+var migrations = []migration{
+	{description: "create etag, file, popularity and package info tables", migrate: execMigration(
+		`CREATE TABLE IF NOT EXISTS etag_contents (version VARCHAR, arch VARCHAR, repo VARCHAR, current VARCHAR, PRIMARY KEY(version, arch, repo))`,
+		`CREATE TABLE IF NOT EXISTS etag_popularity (version VARCHAR, current VARCHAR, PRIMARY KEY(version))`,
+		`CREATE TABLE IF NOT EXISTS etag_packageinfo (version VARCHAR, repo VARCHAR, arch VARCHAR, current VARCHAR, PRIMARY KEY(version, repo, arch))`,
+		`CREATE TABLE IF NOT EXISTS file2package (version VARCHAR, arch VARCHAR, repo VARCHAR, path VARCHAR, package VARCHAR, PRIMARY KEY(version, arch, repo, path, package))`,
+		`CREATE TABLE IF NOT EXISTS package2popularity (version VARCHAR, package VARCHAR, popularity INTEGER, PRIMARY KEY(version, package))`,
+		`CREATE TABLE IF NOT EXISTS packageinfo (version VARCHAR, repo VARCHAR, package VARCHAR, package_version VARCHAR, arch VARCHAR, filename VARCHAR,
+			PRIMARY KEY(version, package, package_version, arch))`,
+	)},
+	{description: "add package info columns", migrate: func(tx *sql.Tx) error {
+		return addMissingColumns(tx, "packageinfo", packageInfoColumns)
+	}},
+	{description: "create relation table", migrate: execMigration(
+		`CREATE TABLE IF NOT EXISTS relation (version VARCHAR, repo VARCHAR, arch VARCHAR, package VARCHAR, package_version VARCHAR,
+			field VARCHAR, alternative INTEGER, position INTEGER, name VARCHAR, arch_qualifier VARCHAR, op VARCHAR, rel_version VARCHAR, arches VARCHAR, profiles VARCHAR,
+			PRIMARY KEY(version, arch, package, package_version, field, alternative, position))`,
+		`CREATE INDEX IF NOT EXISTS relation_name_idx ON relation(version, name)`,
+	)},
+	{description: "create release table", migrate: execMigration(
+		`CREATE TABLE IF NOT EXISTS release (version VARCHAR, updated INTEGER, content BLOB, PRIMARY KEY(version))`,
+	)},
+	{description: "intern suites, packages and directories of files", migrate: internFiles, vacuum: true},
+	{description: "create index checksum table", migrate: execMigration(
+		`CREATE TABLE IF NOT EXISTS index_sha256 (version VARCHAR, path VARCHAR, sha256 VARCHAR, PRIMARY KEY(version, path))`,
+	)},
+	{description: "add release signature column", migrate: func(tx *sql.Tx) error {
+		return addMissingColumns(tx, "release", []string{"signature BLOB"})
+	}},
+}
+
+// migrate applies the migrations a database hasn't seen yet in a single
+// transaction. Databases of newer versions of godebian are refused, as they
+// might have a schema this version can't handle.
+func (db *SqliteDb) migrate() error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not migrate db: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: %s has schema version %d, but only %d is supported", ErrSchemaTooNew, db.dbPath, version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	vacuum := false
+	for i := version; i < len(migrations); i++ {
+		err = migrations[i].migrate(tx)
+		if err != nil {
+			return fmt.Errorf("migrating db to schema version %d (%s) failed: %w", i+1, migrations[i].description, err)
+		}
+		vacuum = vacuum || migrations[i].vacuum
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)))
+	if err != nil {
+		return fmt.Errorf("could not set schema version: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not migrate db: %w", err)
+	}
+
+	if vacuum {
+		// give the freed space back
+		_, err = db.db.Exec("VACUUM")
+	}
+
+	return err
+}
+
+// execMigration returns a migration executing stmts.
+func execMigration(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// packageInfoColumns are the columns of packageinfo that were added after
+// the table was introduced.
+var packageInfoColumns = []string{
+	"architecture VARCHAR",
+	"source VARCHAR",
+	"section VARCHAR",
+	"priority VARCHAR",
+	"maintainer VARCHAR",
+	"installed_size INTEGER",
+	"size INTEGER",
+	"sha256 VARCHAR",
+	"md5sum VARCHAR",
+	"homepage VARCHAR",
+	"multi_arch VARCHAR",
+	"description VARCHAR",
+	"long_description VARCHAR",
+	"depends VARCHAR",
+	"pre_depends VARCHAR",
+	"recommends VARCHAR",
+	"suggests VARCHAR",
+	"conflicts VARCHAR",
+	"breaks VARCHAR",
+	"replaces VARCHAR",
+	"provides VARCHAR",
+	"enhances VARCHAR",
+	"control VARCHAR",
+}
+
+// addMissingColumns adds those columns to table that databases created by
+// older versions don't have yet.
+func addMissingColumns(tx *sql.Tx, table string, columns []string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		if existing[name] {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column))
+		if err != nil {
+			return fmt.Errorf("could not add column %s to %s: %w", name, table, err)
+		}
+	}
+
+	return nil
+}
+
+// internFiles moves the files of the flat table file2package to tables
+// that intern suites, i.e. version, arch and repo, package names and
+// directories, so that a file only stores ids and its base name. The view
+// file2package joins them to the columns of the flat table.
+func internFiles(tx *sql.Tx) error {
+	var flatTables int
+	err := tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'file2package'`).Scan(&flatTables)
+	if err != nil {
+		return err
+	}
+	if flatTables > 0 {
+		_, err = tx.Exec(`ALTER TABLE file2package RENAME TO file2package_flat`)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = execMigration(
+		`CREATE TABLE IF NOT EXISTS suite (id INTEGER PRIMARY KEY, version VARCHAR, arch VARCHAR, repo VARCHAR, UNIQUE(version, arch, repo))`,
+		`CREATE TABLE IF NOT EXISTS package (id INTEGER PRIMARY KEY, name VARCHAR UNIQUE)`,
+		`CREATE TABLE IF NOT EXISTS dir (id INTEGER PRIMARY KEY, path VARCHAR UNIQUE)`,
+		`CREATE TABLE IF NOT EXISTS file (id INTEGER PRIMARY KEY, suite_id INTEGER, dir_id INTEGER, name VARCHAR, package_id INTEGER,
+			UNIQUE(dir_id, name, suite_id, package_id))`,
+		`CREATE INDEX IF NOT EXISTS file_name_idx ON file(name)`,
+		`CREATE INDEX IF NOT EXISTS file_suite_idx ON file(suite_id)`,
+		`CREATE INDEX IF NOT EXISTS file_package_idx ON file(package_id)`,
+		`CREATE VIEW IF NOT EXISTS file2package AS
+			SELECT f.id, s.version, s.arch, s.repo, d.path AS dir, f.name, d.path || '/' || f.name AS path, p.name AS package
+			FROM file AS f
+				JOIN suite AS s ON s.id = f.suite_id
+				JOIN dir AS d ON d.id = f.dir_id
+				JOIN package AS p ON p.id = f.package_id`,
+	)(tx)
+	if err != nil || flatTables == 0 {
+		return err
+	}
+
+	// dir is the path up to the last slash
+	const flatDirs = `SELECT version, arch, repo, path, package,
+			substr(rtrim(path, replace(path, '/', '')), 1, length(rtrim(path, replace(path, '/', ''))) - 1) AS dir
+		FROM file2package_flat`
+
+	return execMigration(
+		`INSERT OR IGNORE INTO suite (version, arch, repo) SELECT DISTINCT version, arch, repo FROM file2package_flat`,
+		`INSERT OR IGNORE INTO package (name) SELECT DISTINCT package FROM file2package_flat`,
+		`INSERT OR IGNORE INTO dir (path) SELECT DISTINCT dir FROM (`+flatDirs+`)`,
+		`INSERT OR IGNORE INTO file (suite_id, dir_id, name, package_id)
+			SELECT s.id, d.id, substr(flat.path, length(flat.dir) + 2), p.id
+			FROM (`+flatDirs+`) AS flat
+				JOIN suite AS s ON s.version = flat.version AND s.arch = flat.arch AND s.repo = flat.repo
+				JOIN dir AS d ON d.path = flat.dir
+				JOIN package AS p ON p.name = flat.package`,
+		`DROP TABLE file2package_flat`,
+		// the path index of the flat table is rebuilt by createPathIndex
+		`DROP TABLE IF EXISTS file2package_fts`,
+	)(tx)
+}
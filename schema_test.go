@@ -0,0 +1,91 @@
+package godebian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func schemaVersion(t *testing.T, d *SqliteDb) int {
+	var version int
+	err := d.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return version
+}
+
+func TestOpenSetsSchemaVersion(t *testing.T) {
+	d := newTestDb(t)
+
+	if version := schemaVersion(t, d); version != len(migrations) {
+		t.Errorf("schema version should be %d, but is %d", len(migrations), version)
+	}
+}
+
+func TestOpenRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	d := SqliteDb{dbPath: path}
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.Close()
+
+	d = SqliteDb{dbPath: path}
+	err = d.Open()
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening db of newer version should fail, but error is %v", err)
+	}
+}
+
+func TestOpenMigratesUnversionedDb(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "godebian.sqlite")
+	d := SqliteDb{dbPath: path}
+	err := d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageFile(ctx, "debian/stable", "amd64", "main", "/usr/bin/ls", "coreutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.InsertPackageInfo(ctx, "debian/stable", "main", "amd64", PackageInfo{Name: "coreutils", Version: "9.1-1", Filename: "pool/main/c/coreutils/coreutils_9.1-1_amd64.deb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// databases written before schema versions have any state of the schema
+	_, err = d.db.Exec("PRAGMA user_version = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.Close()
+
+	d = SqliteDb{dbPath: path}
+	err = d.Open()
+	if err != nil {
+		t.Fatalf("migrating unversioned db failed: %v", err)
+	}
+	if version := schemaVersion(t, &d); version != len(migrations) {
+		t.Errorf("schema version should be %d, but is %d", len(migrations), version)
+	}
+
+	pkgs, err := d.GetPackage(ctx, "debian/stable", "/usr/bin/ls")
+	if err != nil || strings.Join(pkgs, " ") != "coreutils" {
+		t.Errorf("/usr/bin/ls should belong to coreutils after migration, but belongs to %v (%v)", pkgs, err)
+	}
+	pi, err := d.GetPackageInfo(ctx, "debian/stable", "amd64", "coreutils")
+	if err != nil || pi.Filename != "pool/main/c/coreutils/coreutils_9.1-1_amd64.deb" {
+		t.Errorf("package info should survive migration, but is %+v (%v)", pi, err)
+	}
+}
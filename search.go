@@ -0,0 +1,164 @@
+package godebian
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// SearchMode selects how the path passed to Search is matched.
+type SearchMode int
+
+const (
+	// SearchExact matches an absolute path, or the file name of a path if
+	// the pattern doesn't start with "/".
+	SearchExact SearchMode = iota
+	// SearchRegexp matches paths containing a match of a regular expression
+	// in RE2 syntax, e.g. `/usr/lib/.*/libssl\.so\..*`.
+	SearchRegexp
+	// SearchGlob matches whole paths against a shell glob like
+	// "/usr/share/doc/*/copyright"; "*" and "?" don't match "/".
+	SearchGlob
+	// SearchSubstring matches paths containing the pattern.
+	SearchSubstring
+)
+
+// SearchOptions configure Search.
+type SearchOptions struct {
+	Mode SearchMode
+	// IgnoreCase makes regexp, glob and substring searches case
+	// insensitive.
+	IgnoreCase bool
+}
+
+// PathMatcher selects the paths of a search. Databases may narrow the paths
+// down to those containing Literal, ignoring the case of ASCII letters, and
+// Match decides.
+type PathMatcher struct {
+	Literal string
+	Match   func(path string) bool
+}
+
+func newPathMatcher(pattern string, opts SearchOptions) (PathMatcher, error) {
+	switch opts.Mode {
+	case SearchSubstring:
+		if opts.IgnoreCase && !isASCII(pattern) {
+			return regexpMatcher(regexp.QuoteMeta(pattern), true)
+		}
+		if opts.IgnoreCase {
+			lower := strings.ToLower(pattern)
+			return PathMatcher{Literal: pattern, Match: func(path string) bool {
+				return strings.Contains(strings.ToLower(path), lower)
+			}}, nil
+		}
+		return PathMatcher{Literal: pattern, Match: func(path string) bool {
+			return strings.Contains(path, pattern)
+		}}, nil
+	case SearchGlob:
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return PathMatcher{}, err
+		}
+		return regexpMatcher(re, opts.IgnoreCase)
+	case SearchRegexp:
+		return regexpMatcher(pattern, opts.IgnoreCase)
+	}
+
+	return PathMatcher{}, fmt.Errorf("unsupported search mode %d", opts.Mode)
+}
+
+func regexpMatcher(pattern string, ignoreCase bool) (PathMatcher, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return PathMatcher{}, err
+	}
+
+	literal := requiredLiteral(pattern)
+	if ignoreCase && !isASCII(literal) {
+		// LIKE only folds the case of ASCII characters
+		literal = ""
+	}
+
+	return PathMatcher{Literal: literal, Match: re.MatchString}, nil
+}
+
+// requiredLiteral returns the longest literal string every match of the
+// regular expression pattern contains, or "" if there is none.
+func requiredLiteral(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	var longest string
+	for _, sub := range subs {
+		if sub.Op == syntax.OpLiteral && len(string(sub.Rune)) > len(longest) {
+			longest = string(sub.Rune)
+		}
+	}
+
+	return longest
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// globToRegexp converts a shell glob to an anchored regular expression.
+func globToRegexp(glob string) (string, error) {
+	var sb strings.Builder
+
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("missing ] in glob %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+
+	return sb.String(), nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern that uses \ as escape
+// character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,82 @@
+package godebian
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	for glob, expected := range map[string]string{
+		"/usr/share/doc/*/copyright": `^/usr/share/doc/[^/]*/copyright$`,
+		"/usr/lib/lib?.so.[0-9]":     `^/usr/lib/lib[^/]\.so\.[0-9]$`,
+		"/etc/[!a]*\\*":              `^/etc/[^a][^/]*\*$`,
+	} {
+		re, err := globToRegexp(glob)
+		if err != nil || re != expected {
+			t.Errorf("%s should be converted to %s, but is %s (%v)", glob, expected, re, err)
+		}
+	}
+
+	if _, err := globToRegexp("/usr/[abc"); err == nil {
+		t.Errorf("unterminated character class should fail")
+	}
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		`/usr/lib/.*/libssl\.so\..*`:       "/libssl.so.",
+		`^/usr/share/doc/[^/]*/copyright$`: "/usr/share/doc/",
+		`(?i)/bin/ls$`:                     "/BIN/LS",
+		`foo|bar`:                          "",
+	} {
+		if literal := requiredLiteral(pattern); literal != expected {
+			t.Errorf("required literal of %s should be %q, but is %q", pattern, expected, literal)
+		}
+	}
+}
+
+func TestSearchModes(t *testing.T) {
+	dc := DebianContents{db: newTestDb(t), distroWithVersion: "debian/stable", arch: "amd64"}
+	err := dc.readContentsFileIntoDB(context.Background(), strings.NewReader(`usr/lib/x86_64-linux-gnu/libssl.so.3	libs/libssl3
+usr/lib/x86_64-linux-gnu/libssl.so	libdevel/libssl-dev
+usr/share/doc/libssl3/copyright	libs/libssl3
+usr/share/doc/libssl3/examples/copyright	libs/libssl-doc
+usr/share/doc/README_Foo	doc/foo-doc
+usr/bin/ls	utils/coreutils
+`), "amd64", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pattern  string
+		opts     SearchOptions
+		expected string
+	}{
+		{"/usr/bin/ls", SearchOptions{}, "coreutils"},
+		{"ls", SearchOptions{}, "coreutils"},
+		{`/usr/lib/.*/libssl\.so\..*`, SearchOptions{Mode: SearchRegexp}, "libssl3"},
+		{`/USR/LIB/.*/LIBSSL\.so$`, SearchOptions{Mode: SearchRegexp, IgnoreCase: true}, "libssl-dev"},
+		{"/usr/share/doc/*/copyright", SearchOptions{Mode: SearchGlob}, "libssl3"},
+		{"/usr/share/doc/*/COPYRIGHT", SearchOptions{Mode: SearchGlob}, ""},
+		{"readme_", SearchOptions{Mode: SearchSubstring, IgnoreCase: true}, "foo-doc"},
+		{"readme_", SearchOptions{Mode: SearchSubstring}, ""},
+		{"ssl", SearchOptions{Mode: SearchSubstring}, "libssl-dev libssl-doc libssl3"},
+	} {
+		pkgs, err := dc.Search(tc.pattern, tc.opts)
+		if err != nil {
+			t.Errorf("searching %s failed: %v", tc.pattern, err)
+			continue
+		}
+		sort.Strings(pkgs)
+		if strings.Join(pkgs, " ") != tc.expected {
+			t.Errorf("searching %s with %+v should return %q, but returned %q", tc.pattern, tc.opts, tc.expected, strings.Join(pkgs, " "))
+		}
+	}
+
+	if _, err := dc.Search("(", SearchOptions{Mode: SearchRegexp}); err == nil {
+		t.Errorf("invalid regular expression should fail")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !sqlite_purego
+
+package godebian
+
+import _ "github.com/mattn/go-sqlite3"
+
+// sqliteDriver is the database/sql driver of SqliteDb; build with the tag
+// sqlite_purego to use a driver that doesn't need cgo.
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN returns the data source name of the database at path.
+func sqliteDSN(path string) string {
+	// transactions take the write lock at once, so they wait for other
+	// writers instead of failing when they start writing after reading
+	return path + "?_txlock=immediate"
+}
@@ -0,0 +1,18 @@
+//go:build sqlite_purego
+
+package godebian
+
+import _ "modernc.org/sqlite"
+
+// sqliteDriver is the database/sql driver of SqliteDb; modernc.org/sqlite is
+// SQLite translated to Go, so it builds without cgo and includes FTS5.
+const sqliteDriver = "sqlite"
+
+// sqliteDSN returns the data source name of the database at path.
+func sqliteDSN(path string) string {
+	// like go-sqlite3, wait for locks held by other connections instead of
+	// failing with SQLITE_BUSY at once; transactions take the write lock at
+	// once, so they wait for other writers instead of failing when they
+	// start writing after reading
+	return path + "?_pragma=busy_timeout(5000)&_txlock=immediate"
+}
@@ -0,0 +1,75 @@
+package godebian
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storedVersions collects the rows of the indexed versions of a package in
+// SqliteDb and PostgresDb, which store package infos as their stanzas.
+type storedVersions struct {
+	pkg        string
+	candidates []PackageInfo
+	controls   map[string]string
+}
+
+func (s *storedVersions) add(pkgVersion, filename, control string) {
+	if s.controls == nil {
+		s.controls = make(map[string]string)
+	}
+
+	s.candidates = append(s.candidates, PackageInfo{Name: s.pkg, Version: pkgVersion, Filename: filename})
+	s.controls[pkgVersion] = control
+}
+
+// newest returns the package info of the newest version; its relations are
+// those of the stanza.
+func (s *storedVersions) newest() (PackageInfo, error) {
+	pi, ok := NewestPackageInfo(s.candidates)
+	if !ok {
+		return pi, fmt.Errorf("%w: package %s", ErrNotFound, s.pkg)
+	}
+
+	// packages imported by older versions only have a file name
+	control := s.controls[pi.Version]
+	if control == "" {
+		return pi, nil
+	}
+
+	p, err := ParseParagraph(strings.Split(control, "\n"))
+	if err != nil {
+		return pi, fmt.Errorf("parsing stored stanza of %s failed: %w", s.pkg, err)
+	}
+
+	return packageInfoFromParagraph(p)
+}
+
+// storedRelation returns r with the architectures and profiles of a row of
+// the relation table.
+func storedRelation(r Relation, arches, profiles string) Relation {
+	r.Arches = strings.Fields(arches)
+	r.Profiles = parseProfiles(profiles)
+
+	return r
+}
+
+// clearRelations empties the relation fields of pi before the stored ones
+// are added with addRelation.
+func clearRelations(pi *PackageInfo) {
+	for _, field := range RelationFields {
+		*pi.relationsOf(field) = nil
+	}
+}
+
+// addRelation adds r, a row of the relation table, to pi; the rows have to
+// be ordered by field, alternative and position.
+func addRelation(pi *PackageInfo, field string, alternative int, r Relation) {
+	relations := pi.relationsOf(field)
+	if relations == nil {
+		return
+	}
+	if alternative >= len(*relations) {
+		*relations = append(*relations, nil)
+	}
+	(*relations)[len(*relations)-1] = append((*relations)[len(*relations)-1], r)
+}
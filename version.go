@@ -0,0 +1,254 @@
+package godebian
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a Debian package version of the form
+// [epoch:]upstream_version[-debian_revision].
+type Version struct {
+	Epoch    uint
+	Upstream string
+	Revision string
+}
+
+// ParseVersion parses a Debian package version like "1:2.36-9+deb12u4".
+func ParseVersion(s string) (Version, error) {
+	var v Version
+
+	orig := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return v, fmt.Errorf("empty version")
+	}
+
+	if epoch, rest, found := strings.Cut(s, ":"); found {
+		e, err := strconv.ParseUint(epoch, 10, 32)
+		if err != nil {
+			return v, fmt.Errorf("invalid epoch in version %q", orig)
+		}
+		v.Epoch = uint(e)
+		s = rest
+	}
+
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		v.Revision = s[i+1:]
+		s = s[:i]
+		if v.Revision == "" {
+			return v, fmt.Errorf("empty revision in version %q", orig)
+		}
+	}
+	v.Upstream = s
+
+	if v.Upstream == "" {
+		return v, fmt.Errorf("empty upstream version in %q", orig)
+	}
+	for _, c := range v.Upstream {
+		if !isVersionChar(c) && c != '-' && c != ':' {
+			return v, fmt.Errorf("invalid character %q in version %q", c, orig)
+		}
+	}
+	for _, c := range v.Revision {
+		if !isVersionChar(c) {
+			return v, fmt.Errorf("invalid character %q in revision of %q", c, orig)
+		}
+	}
+
+	return v, nil
+}
+
+func isVersionChar(c rune) bool {
+	return isDigit(c) || isLetter(c) || c == '.' || c == '+' || c == '~'
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (v Version) String() string {
+	s := v.Upstream
+	if v.Epoch > 0 {
+		s = fmt.Sprintf("%d:%s", v.Epoch, s)
+	}
+	if v.Revision != "" {
+		s += "-" + v.Revision
+	}
+
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is older than, equal to or newer than o
+// in the order used by dpkg.
+func (v Version) Compare(o Version) int {
+	if v.Epoch != o.Epoch {
+		if v.Epoch < o.Epoch {
+			return -1
+		}
+		return 1
+	}
+
+	if c := compareVersionPart(v.Upstream, o.Upstream); c != 0 {
+		return c
+	}
+
+	return compareVersionPart(v.Revision, o.Revision)
+}
+
+// Satisfies reports whether v satisfies the version constraint "op o" of a
+// relation; it is always true for an empty op.
+func (v Version) Satisfies(op string, o Version) bool {
+	c := v.Compare(o)
+
+	switch op {
+	case "":
+		return true
+	case "<<":
+		return c < 0
+	case "<=", "<":
+		return c <= 0
+	case "=":
+		return c == 0
+	case ">=", ">":
+		return c >= 0
+	case ">>":
+		return c > 0
+	}
+
+	return false
+}
+
+// CompareVersions compares the versions a and b like Version.Compare.
+func CompareVersions(a, b string) (int, error) {
+	va, err := ParseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := ParseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return va.Compare(vb), nil
+}
+
+// charOrder is the weight of a non-digit character of a version: "~" sorts
+// before everything, even the end of the part, and letters sort before
+// other characters.
+func charOrder(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+
+	c := rune(s[i])
+	switch {
+	case isDigit(c):
+		return 0
+	case isLetter(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+
+	return int(c) + 256
+}
+
+// compareVersionPart compares upstream versions or revisions by alternating
+// between non-digit parts, compared with charOrder, and numeric parts.
+func compareVersionPart(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(rune(a[i]))) || (j < len(b) && !isDigit(rune(b[j]))) {
+			ac, bc := charOrder(a, i), charOrder(b, j)
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+
+		firstDiff := 0
+		for i < len(a) && isDigit(rune(a[i])) && j < len(b) && isDigit(rune(b[j])) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(rune(a[i])) {
+			return 1
+		}
+		if j < len(b) && isDigit(rune(b[j])) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+
+	return 0
+}
+
+func sign(i int) int {
+	if i < 0 {
+		return -1
+	}
+	if i > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// SatisfiedBy reports whether a package of version v satisfies the version
+// constraint of r; invalid versions in r never match.
+func (r Relation) SatisfiedBy(v Version) bool {
+	if r.Op == "" {
+		return true
+	}
+
+	rv, err := ParseVersion(r.Version)
+	if err != nil {
+		return false
+	}
+
+	return v.Satisfies(r.Op, rv)
+}
+
+// NewestPackageInfo returns the package with the highest version, e.g. of the
+// package infos of the same package in several suites; packages with invalid
+// versions are only returned if there is no other candidate. It returns false
+// if pis is empty.
+func NewestPackageInfo(pis []PackageInfo) (PackageInfo, bool) {
+	var newest PackageInfo
+	var newestVersion Version
+	found, valid := false, false
+
+	for _, pi := range pis {
+		v, err := ParseVersion(pi.Version)
+		if err != nil {
+			if !found {
+				newest, found = pi, true
+			}
+			continue
+		}
+		if !valid || v.Compare(newestVersion) > 0 {
+			newest, newestVersion = pi, v
+			found, valid = true, true
+		}
+	}
+
+	return newest, found
+}
@@ -0,0 +1,92 @@
+package godebian
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		c    int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.010", "1.10", 0},
+		{"1:0.1", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0+", "1.0.1", -1},
+		{"2.36-9+deb12u3", "2.36-9+deb12u4", -1},
+		{"2.36-9", "2.36-9+deb12u4", -1},
+		{"4:12.2.0-3", "12.2.0-14", 1},
+		{"1.2-3-4", "1.2-3-3", 1},
+		{"1.2-3-4", "1.2-3", 1},
+		{"a", "1", 1},
+	} {
+		c, err := CompareVersions(tc.a, tc.b)
+		if err != nil {
+			t.Errorf("comparing %s and %s failed: %v", tc.a, tc.b, err)
+			continue
+		}
+		if c != tc.c {
+			t.Errorf("%s compared to %s should be %d, but is %d", tc.a, tc.b, tc.c, c)
+		}
+		if c, _ := CompareVersions(tc.b, tc.a); c != -tc.c {
+			t.Errorf("%s compared to %s should be %d, but is %d", tc.b, tc.a, -tc.c, c)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("1:2.36-9+deb12u4")
+	if err != nil || v.Epoch != 1 || v.Upstream != "2.36" || v.Revision != "9+deb12u4" || v.String() != "1:2.36-9+deb12u4" {
+		t.Errorf("unexpected version %+v (%v)", v, err)
+	}
+
+	v, err = ParseVersion("1:2.0:1-1")
+	if err != nil || v.Upstream != "2.0:1" {
+		t.Errorf("upstream version may contain colons, but is %+v (%v)", v, err)
+	}
+
+	for _, invalid := range []string{"", "a:1.0", "1.0-", "1:", "1.0_1", "1.0-1:1"} {
+		if _, err := ParseVersion(invalid); err == nil {
+			t.Errorf("%q should not parse", invalid)
+		}
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	v, _ := ParseVersion("2.36-9")
+	for _, tc := range []struct {
+		op, version string
+		satisfies   bool
+	}{
+		{"", "", true},
+		{">=", "2.36", true},
+		{">>", "2.36", true},
+		{"<<", "2.36-9", false},
+		{"<=", "2.36-9", true},
+		{"=", "2.36-9", true},
+		{"=", "2.36", false},
+		{"<<", "2.37~", true},
+	} {
+		r := Relation{Name: "libc6", Op: tc.op, Version: tc.version}
+		if r.SatisfiedBy(v) != tc.satisfies {
+			t.Errorf("2.36-9 satisfying %s should be %v", r, tc.satisfies)
+		}
+	}
+}
+
+func TestNewestPackageInfo(t *testing.T) {
+	pi, ok := NewestPackageInfo([]PackageInfo{{Version: "invalid_"}, {Version: "1.0-1"}, {Version: "1:0.9"}, {Version: "1.0-2"}})
+	if !ok || pi.Version != "1:0.9" {
+		t.Errorf("newest version should be 1:0.9, but is %q", pi.Version)
+	}
+
+	if _, ok := NewestPackageInfo(nil); ok {
+		t.Errorf("no package info should not return a newest package")
+	}
+}